@@ -0,0 +1,197 @@
+// Helps with the integration of nomad with bbolt databases
+package bolt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mcls/nomad"
+	bolt "go.etcd.io/bbolt"
+)
+
+// NewRunner creates a nomad.Runner for migrations of a bbolt database
+func NewRunner(db *bolt.DB, list *nomad.List) *nomad.Runner {
+	ctx := NewContext(db)
+	vs := NewVersionStore(db)
+	vs.Context = ctx
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
+}
+
+// Context is passed to every migration. Depending on the transaction mode Tx
+// is the read-write transaction the migration runs in, or nil when it runs
+// without one. Don't open other transactions while Tx is open, since bbolt
+// only allows one writer and can deadlock on readers in the same goroutine.
+type Context struct {
+	DB        *bolt.DB
+	Tx        *bolt.Tx
+	TxMode    nomad.TxMode     // Default transaction mode, TxPerMigration if unset
+	Migration *nomad.Migration // Migration that's currently running
+}
+
+func NewContext(db *bolt.DB) *Context {
+	return &Context{DB: db}
+}
+
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+}
+
+// Update runs f in the migration's transaction, or in a transaction of its
+// own when the migration runs without one
+func (c *Context) Update(f func(tx *bolt.Tx) error) error {
+	if c.Tx != nil {
+		return f(c.Tx)
+	}
+	return c.DB.Update(f)
+}
+
+// TxModes implements nomad.Transactional
+func (c *Context) TxModes() (run, migration nomad.TxMode) {
+	run = c.TxMode
+	if run == nomad.TxDefault {
+		run = nomad.TxPerMigration
+	}
+	if c.Migration == nil || c.Migration.TxMode == nomad.TxDefault {
+		return run, run
+	}
+	return run, c.Migration.TxMode
+}
+
+// InTx implements nomad.Transactional
+func (c *Context) InTx() bool {
+	return c.Tx != nil
+}
+
+// Begin starts a read-write transaction, used by the hooks
+func (c *Context) Begin() error {
+	tx, err := c.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	c.Tx = tx
+	return nil
+}
+
+// Commit commits the transaction, used by the hooks
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Commit()
+}
+
+// Rollback rolls back the transaction, used by the hooks
+func (c *Context) Rollback() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Rollback()
+}
+
+// NewHooks creates the hooks that manage the transactions of a Context. By
+// default every migration runs in its own read-write transaction, together
+// with the update of its version, so a migration is either applied with its
+// version or not at all. TxPerRun and TxNone work like in the pg package.
+func NewHooks() *nomad.Hooks {
+	return (&nomad.TxHooks{}).Hooks()
+}
+
+// DefaultBucket stores the versions, unless VersionStore.Bucket is set
+const DefaultBucket = "schema_migrations"
+
+// VersionStore stores the versions as keys of a bucket. The values are the
+// times the versions were applied, in RFC 3339 format.
+type VersionStore struct {
+	DB *bolt.DB
+	// Bucket stores the versions, DefaultBucket if empty
+	Bucket string
+	// Context, when set, makes version changes part of the transaction the
+	// migration runs in
+	Context *Context
+}
+
+func NewVersionStore(db *bolt.DB) *VersionStore {
+	return &VersionStore{DB: db}
+}
+
+func (vs *VersionStore) bucket() []byte {
+	if vs.Bucket == "" {
+		return []byte(DefaultBucket)
+	}
+	return []byte(vs.Bucket)
+}
+
+var errNoBucket = errors.New("The version bucket doesn't exist, call SetupVersionStore first")
+
+// view runs f in the migration's transaction, if there is one, since opening
+// another transaction could deadlock
+func (vs *VersionStore) view(f func(b *bolt.Bucket) error) error {
+	g := func(tx *bolt.Tx) error {
+		b := tx.Bucket(vs.bucket())
+		if b == nil {
+			return errNoBucket
+		}
+		return f(b)
+	}
+	if vs.Context != nil && vs.Context.Tx != nil {
+		return g(vs.Context.Tx)
+	}
+	return vs.DB.View(g)
+}
+
+func (vs *VersionStore) update(f func(b *bolt.Bucket) error) error {
+	g := func(tx *bolt.Tx) error {
+		b := tx.Bucket(vs.bucket())
+		if b == nil {
+			return errNoBucket
+		}
+		return f(b)
+	}
+	if vs.Context != nil {
+		return vs.Context.Update(g)
+	}
+	return vs.DB.Update(g)
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	found := false
+	err := vs.view(func(b *bolt.Bucket) error {
+		found = b.Get([]byte(v)) != nil
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return found
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	return vs.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(v), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+func (vs *VersionStore) RemoveVersion(v string) error {
+	return vs.update(func(b *bolt.Bucket) error {
+		return b.Delete([]byte(v))
+	})
+}
+
+// SetupVersionStore creates the bucket to store the versions
+func (vs *VersionStore) SetupVersionStore() error {
+	return vs.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(vs.bucket())
+		return err
+	})
+}
+
+// Versions returns the applied versions, in order
+func (vs *VersionStore) Versions() ([]string, error) {
+	versions := []string{}
+	err := vs.view(func(b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			versions = append(versions, string(k))
+			return nil
+		})
+	})
+	return versions, err
+}
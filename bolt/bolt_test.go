@@ -0,0 +1,197 @@
+package bolt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcls/nomad"
+	bolt "go.etcd.io/bbolt"
+)
+
+func setupDatabase(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func put(bucket, key string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		b, err := ctx.(*Context).Tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte("1"))
+	}
+}
+
+func deleteBucket(bucket string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		return ctx.(*Context).Tx.DeleteBucket([]byte(bucket))
+	}
+}
+
+func bucketExists(t *testing.T, db *bolt.DB, bucket string) bool {
+	exists := false
+	err := db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(bucket)) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestImplementsInterfaces(t *testing.T) {
+	var _ nomad.VersionStore = NewVersionStore(nil)
+	var _ nomad.VersionLister = NewVersionStore(nil)
+	var _ nomad.MigrationSetter = NewContext(nil)
+}
+
+func TestRunAndRollback(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: put("users", "mcls"), Down: deleteBucket("users")})
+	l.Add(&nomad.Migration{Version: "B", Up: put("blogs", "1"), Down: deleteBucket("blogs")})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !runner.HasVersion("B") || !bucketExists(t, db, "blogs") {
+		t.Fatal("Expected A and B to be applied")
+	}
+	versions, err := runner.VersionStore.(*VersionStore).Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0] != "A" || versions[1] != "B" {
+		t.Fatalf("Wrong versions: %v", versions)
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.HasVersion("B") || bucketExists(t, db, "blogs") {
+		t.Fatal("Expected B to be rolled back")
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Should have version A")
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: put("users", "mcls")})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			if err := put("blogs", "1")(ctx); err != nil {
+				return err
+			}
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if !runner.HasVersion("A") || !bucketExists(t, db, "users") {
+		t.Fatal("A should have been committed")
+	}
+	if runner.HasVersion("B") || bucketExists(t, db, "blogs") {
+		t.Fatal("B should have been rolled back")
+	}
+}
+
+func TestFailedVersionUpdateIsRolledBack(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			// Removing the version bucket makes the version update fail
+			if err := put("users", "mcls")(ctx); err != nil {
+				return err
+			}
+			return ctx.(*Context).Tx.DeleteBucket([]byte(DefaultBucket))
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if bucketExists(t, db, "users") || !bucketExists(t, db, DefaultBucket) {
+		t.Fatal("The migration should have been rolled back with its version")
+	}
+}
+
+func TestRunningMigrations_TxPerRun(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: put("users", "mcls")})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if runner.HasVersion("A") || bucketExists(t, db, "users") {
+		t.Fatal("A should have been rolled back with the run")
+	}
+}
+
+func TestRunningMigrations_TxNone(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		TxMode:  nomad.TxNone,
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if c.Tx != nil {
+				return errors.New("Shouldn't run in a transaction")
+			}
+			return c.Update(func(tx *bolt.Tx) error {
+				_, err := tx.CreateBucket([]byte("users"))
+				return err
+			})
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !bucketExists(t, db, "users") {
+		t.Fatal("Expected A to be applied")
+	}
+}
+
+func TestVersionStore_Bucket(t *testing.T) {
+	db := setupDatabase(t)
+	vs := NewVersionStore(db)
+	vs.Bucket = "other_migrations"
+	if err := vs.SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.AddVersion("A"); err != nil {
+		t.Fatal(err)
+	}
+	if !vs.HasVersion("A") || !bucketExists(t, db, "other_migrations") || bucketExists(t, db, DefaultBucket) {
+		t.Fatal("Expected the version in other_migrations")
+	}
+}
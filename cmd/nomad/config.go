@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Settings describe how to reach the database and where the migrations are
+type Settings struct {
+	Driver      string `yaml:"driver"`
+	DatabaseURL string `yaml:"database_url"`
+	Dir         string `yaml:"dir"`
+	Table       string `yaml:"table"`
+}
+
+// Config is read from the config file. Every environment overrides the
+// settings at the top level that it sets.
+//
+//	driver: postgres
+//	dir: db/migrations
+//	database_url: postgres://localhost/app_development?sslmode=disable
+//	environments:
+//	  production:
+//	    database_url: ${DATABASE_URL}
+type Config struct {
+	Settings     `yaml:",inline"`
+	Environments map[string]Settings `yaml:"environments"`
+}
+
+var defaultSettings = Settings{
+	Driver:      "postgres",
+	DatabaseURL: "${DATABASE_URL}",
+	Dir:         "migrations",
+}
+
+// loadConfig reads the config file. A missing file is only an error when it
+// has to exist, otherwise the defaults are used.
+func loadConfig(file string, mustExist bool) (*Config, error) {
+	config := &Config{}
+	data, err := os.ReadFile(file)
+	switch {
+	case os.IsNotExist(err) && !mustExist:
+		return config, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return config, nil
+}
+
+// Environment returns the settings of an environment, or the ones at the top
+// level when env is empty. Environment variables in the values are expanded.
+func (c *Config) Environment(env string) (Settings, error) {
+	s := defaultSettings
+	s.override(c.Settings)
+	if env != "" {
+		settings, ok := c.Environments[env]
+		if !ok {
+			return s, fmt.Errorf("Unknown environment %q", env)
+		}
+		s.override(settings)
+	}
+	for _, value := range []*string{&s.Driver, &s.DatabaseURL, &s.Dir, &s.Table} {
+		*value = os.ExpandEnv(*value)
+	}
+	return s, nil
+}
+
+// override replaces the settings that are set in o
+func (s *Settings) override(o Settings) {
+	if o.Driver != "" {
+		s.Driver = o.Driver
+	}
+	if o.DatabaseURL != "" {
+		s.DatabaseURL = o.DatabaseURL
+	}
+	if o.Dir != "" {
+		s.Dir = o.Dir
+	}
+	if o.Table != "" {
+		s.Table = o.Table
+	}
+}
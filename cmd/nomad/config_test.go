@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `driver: postgres
+dir: db/migrations
+database_url: postgres://localhost/app_development
+environments:
+  production:
+    database_url: ${PRODUCTION_URL}
+    table: app.migrations
+`
+
+func writeConfig(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "nomad.yml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfig_Environment(t *testing.T) {
+	t.Setenv("PRODUCTION_URL", "postgres://db.example.com/app")
+	config, err := loadConfig(writeConfig(t, testConfig), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := config.Environment("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Settings{"postgres", "postgres://localhost/app_development", "db/migrations", ""}
+	if s != want {
+		t.Fatalf("Expected %+v, got %+v", want, s)
+	}
+
+	s, err = config.Environment("production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Settings{"postgres", "postgres://db.example.com/app", "db/migrations", "app.migrations"}
+	if s != want {
+		t.Fatalf("Expected %+v, got %+v", want, s)
+	}
+
+	if _, err := config.Environment("staging"); err == nil || err.Error() != `Unknown environment "staging"` {
+		t.Fatalf("Expected an error for an unknown environment, got %v", err)
+	}
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/app")
+	missing := filepath.Join(t.TempDir(), "nomad.yml")
+	if _, err := loadConfig(missing, true); err == nil {
+		t.Fatal("Expected an error for a missing config file")
+	}
+	config, err := loadConfig(missing, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := config.Environment("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Settings{"postgres", "postgres://localhost/app", "migrations", ""}
+	if s != want {
+		t.Fatalf("Expected %+v, got %+v", want, s)
+	}
+}
+
+func TestConfig_UnknownKey(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, "databse_url: postgres://localhost/app\n"), true)
+	if err == nil || !strings.Contains(err.Error(), "databse_url") {
+		t.Fatalf("Expected an error for the misspelled key, got %v", err)
+	}
+}
+
+func TestNewCmd(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "migrations")
+	config := writeConfig(t, "dir: "+dir+"\n")
+
+	var out bytes.Buffer
+	cmd := newRootCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--config", config, "new", "create_users"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*_create_users.*.sql"))
+	if len(files) != 2 {
+		t.Fatalf("Expected an up and down file, got %v", files)
+	}
+	if strings.Count(out.String(), "Creating migration") != 2 {
+		t.Fatalf("Expected the files to be printed, got %q", out.String())
+	}
+}
+
+func TestScriptCmd(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_users.up.sql":   "CREATE TABLE users (id int);\n",
+		"001_users.down.sql": "DROP TABLE users;\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("DATABASE_URL", "")
+	config := writeConfig(t, "dir: "+dir+"\ntable: app.migrations\n")
+
+	var out bytes.Buffer
+	cmd := newRootCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--config", config, "script"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "CREATE TABLE users (id int);") ||
+		!strings.Contains(out.String(), `INSERT INTO "app"."migrations" (version) VALUES ('001');`) {
+		t.Fatalf("Wrong script:\n%s", out.String())
+	}
+}
+
+func TestUnsupportedDriver(t *testing.T) {
+	config := writeConfig(t, "driver: oracle\ndatabase_url: oracle://localhost\ndir: "+t.TempDir()+"\n")
+	c := &cli{configFile: config, configSet: true}
+	_, err := c.runner()
+	if err == nil || err.Error() != `Unsupported driver "oracle"` {
+		t.Fatalf("Expected an error for the driver, got %v", err)
+	}
+}
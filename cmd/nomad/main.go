@@ -0,0 +1,193 @@
+// Command nomad runs SQL migrations without writing any Go. It's configured
+// by a nomad.yml file, see Config.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	// Setup postgres and mysql drivers
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/mysql"
+	"github.com/mcls/nomad/pg"
+	"github.com/mcls/nomad/sqlfile"
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// driver opens a runner for the migrations of a list, whose SQL files are
+// split by the syntax of the database
+type driver struct {
+	open   func(s Settings, list *nomad.List) (*nomad.Runner, error)
+	syntax sqlfile.Syntax
+}
+
+var drivers = map[string]driver{
+	"postgres": {openPostgres, sqlfile.SyntaxPostgres},
+	"mysql":    {openMySQL, sqlfile.SyntaxMySQL},
+}
+
+func openPostgres(s Settings, list *nomad.List) (*nomad.Runner, error) {
+	db, err := sql.Open("postgres", s.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	runner := pg.NewRunner(db, list)
+	runner.VersionStore.(*pg.VersionStore).Table = s.Table
+	return runner, nil
+}
+
+func openMySQL(s Settings, list *nomad.List) (*nomad.Runner, error) {
+	db, err := sql.Open("mysql", s.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	runner := mysql.NewRunner(db, list)
+	runner.VersionStore.(*mysql.VersionStore).Table = s.Table
+	return runner, nil
+}
+
+type cli struct {
+	configFile string
+	env        string
+	configSet  bool
+}
+
+func (c *cli) settings() (Settings, error) {
+	config, err := loadConfig(c.configFile, c.configSet)
+	if err != nil {
+		return Settings{}, err
+	}
+	return config.Environment(c.env)
+}
+
+// runner opens a runner for the configured database and migrations. The
+// database is closed when the process exits.
+func (c *cli) runner() (*nomad.Runner, error) {
+	s, err := c.settings()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := drivers[s.Driver]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported driver %q", s.Driver)
+	}
+	if s.DatabaseURL == "" {
+		return nil, fmt.Errorf("No database_url configured")
+	}
+	list, err := d.syntax.LoadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return d.open(s, list)
+}
+
+func newRootCmd() *cobra.Command {
+	c := &cli{}
+	cmdRoot := &cobra.Command{
+		Use:          "nomad",
+		Short:        "run SQL migrations",
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			c.configSet = cmd.Flags().Changed("config")
+		},
+	}
+	cmdRoot.PersistentFlags().StringVarP(&c.configFile, "config", "c", "nomad.yml", "config file")
+	cmdRoot.PersistentFlags().StringVarP(&c.env, "env", "e", os.Getenv("NOMAD_ENV"), "environment of the config file to use")
+
+	cmdNew := &cobra.Command{
+		Use:   "new NAME",
+		Short: "create migration",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := c.settings()
+			if err != nil {
+				return err
+			}
+			files, err := sqlfile.NewGenerator(s.Dir).Create(args[0])
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fmt.Fprintf(cmd.OutOrStdout(), "Creating migration: '%s'\n", file)
+			}
+			return nil
+		},
+	}
+
+	cmdRoot.AddCommand(cmdNew)
+	nomad.AddRunnerCommands(cmdRoot, c.runner)
+	cmdRoot.AddCommand(c.newScriptCmd())
+	cmdRoot.AddCommand(c.newResolveCmd())
+
+	return cmdRoot
+}
+
+func (c *cli) newScriptCmd() *cobra.Command {
+	var opts pg.ScriptOptions
+	var down bool
+	cmd := &cobra.Command{
+		Use:   "script",
+		Short: "write a psql script with the pending migrations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := c.settings()
+			if err != nil {
+				return err
+			}
+			if s.Driver != "postgres" {
+				return fmt.Errorf("Scripts are only supported for postgres, not %q", s.Driver)
+			}
+			scripts, err := sqlfile.LoadScripts(s.Dir)
+			if err != nil {
+				return err
+			}
+			vs := pg.NewVersionStore(nil)
+			vs.Table = s.Table
+			if s.DatabaseURL != "" {
+				if vs.DB, err = sql.Open("postgres", s.DatabaseURL); err != nil {
+					return err
+				}
+				defer vs.DB.Close()
+			}
+			if down {
+				opts.Direction = nomad.DirectionDown
+			}
+			return vs.WriteScript(cmd.OutOrStdout(), scripts, opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.From, "from", "", "first version to include")
+	cmd.Flags().StringVar(&opts.To, "to", "", "last version to include")
+	cmd.Flags().StringVar(&opts.Phase, "phase", "", "only include migrations of this phase (pre or post)")
+	cmd.Flags().BoolVar(&down, "down", false, "write a script that rolls back the migrations")
+	return cmd
+}
+
+func (c *cli) newResolveCmd() *cobra.Command {
+	var applied bool
+	cmd := &cobra.Command{
+		Use:   "resolve VERSION",
+		Short: "clear the dirty mark of a mysql migration that failed partway",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			runner, err := c.runner()
+			if err != nil {
+				return err
+			}
+			vs, ok := runner.VersionStore.(*mysql.VersionStore)
+			if !ok {
+				return fmt.Errorf("Only mysql migrations can be dirty")
+			}
+			return vs.Resolve(args[0], applied)
+		},
+	}
+	cmd.Flags().BoolVar(&applied, "applied", false, "the migration was finished by hand, instead of reverted")
+	return cmd
+}
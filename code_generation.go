@@ -13,6 +13,7 @@ var tplSetup string = `package migrations
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"os"
 
@@ -28,12 +29,31 @@ func init() {
 	Migrations = nomad.NewList()
 }
 
+// Runner creates the runner for the database in DATABASE_URL
 func Runner() *nomad.Runner {
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	runner, err := NewRunner(nomad.RunnerOptions{DatabaseURL: os.Getenv("DATABASE_URL")})
 	if err != nil {
 		log.Fatal(err)
 	}
-	return nomadpg.NewRunner(db, Migrations)
+	return runner
+}
+
+// NewRunner opens the database, which the migration command only does when a
+// subcommand needs it:
+//
+//	nomad.NewLazyMigrationCmd(migrations.NewRunner, nomad.RunnerOptions{
+//		DatabaseURL: os.Getenv("DATABASE_URL"),
+//		Dir:         "./migrations",
+//	})
+func NewRunner(opts nomad.RunnerOptions) (*nomad.Runner, error) {
+	if opts.DatabaseURL == "" {
+		return nil, errors.New("No database, set DATABASE_URL or --database-url")
+	}
+	db, err := sql.Open("postgres", opts.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return nomadpg.NewRunner(db, Migrations), nil
 }
 `
 
@@ -53,7 +73,7 @@ func init() {
 			c := ctx.(*pg.Context)
 			fmt.Println("Up")
 			fmt.Println(c)
-			_, err := c.Tx.Exec("CREATE TABLE ...")
+			_, err := c.Exec("CREATE TABLE ...")
 			return err
 		},
 		Down: func(ctx interface{}) error {
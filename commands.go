@@ -1,12 +1,59 @@
 package nomad
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
 
+// RunnerOptions are passed to a RunnerFactory. The lazy migration command sets
+// them with its --database-url and --dir flags.
+type RunnerOptions struct {
+	DatabaseURL string
+	Dir         string // Where migrations are stored
+}
+
+// RunnerFactory creates the runner of the migration command. It's only called
+// by subcommands that need the database, so e.g. creating a migration works
+// without one.
+type RunnerFactory func(opts RunnerOptions) (*Runner, error)
+
+// NewMigrationCmd creates the migration command for a runner that's already
+// set up. It has no --database-url flag, since runner is connected already.
 func NewMigrationCmd(runner *Runner, migrationDirectory string) *cobra.Command {
+	opts := RunnerOptions{Dir: migrationDirectory}
+	return newMigrationCmd(&opts, func() (*Runner, error) {
+		return runner, nil
+	})
+}
+
+// NewLazyMigrationCmd creates the migration command, which calls factory once
+// a subcommand needs the runner. The flags default to the values of defaults.
+func NewLazyMigrationCmd(factory RunnerFactory, defaults RunnerOptions) *cobra.Command {
+	opts := defaults
+	var runner *Runner
+	cmdRoot := newMigrationCmd(&opts, func() (*Runner, error) {
+		if runner == nil {
+			var err error
+			if runner, err = factory(opts); err != nil {
+				return nil, err
+			}
+		}
+		return runner, nil
+	})
+	cmdRoot.PersistentFlags().StringVar(&opts.DatabaseURL, "database-url", defaults.DatabaseURL, "database to migrate")
+	return cmdRoot
+}
+
+// newMigrationCmd creates the migration command with the flags both kinds of
+// it have
+func newMigrationCmd(opts *RunnerOptions, getRunner func() (*Runner, error)) *cobra.Command {
 	cmdRoot := &cobra.Command{
 		Use:   "migration",
 		Short: "migration subcommands",
@@ -14,41 +61,224 @@ func NewMigrationCmd(runner *Runner, migrationDirectory string) *cobra.Command {
 			cmd.Usage()
 		},
 	}
+	cmdRoot.PersistentFlags().StringVar(&opts.Dir, "dir", opts.Dir, "where migrations are stored")
 
 	cmdNew := &cobra.Command{
 		Use:   "new",
 		Short: "create migration",
 		Run: func(cmd *cobra.Command, args []string) {
-			cg := NewCodeGenerator(migrationDirectory)
+			cg := NewCodeGenerator(opts.Dir)
 			if err := cg.Create(args[0]); err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
 
+	cmdRoot.AddCommand(cmdNew)
+	AddRunnerCommands(cmdRoot, getRunner)
+
+	return cmdRoot
+}
+
+// Exit codes of the run, rollback and status commands, so pipelines can gate
+// deploys on them
+const (
+	ExitFailure         = 1 // Any error without a more specific code
+	ExitPending         = 2 // status --exit-code found pending migrations
+	ExitDrift           = 3 // status --exit-code found applied migrations that aren't in the list
+	ExitLockNotAcquired = 4 // Another run holds the lock
+	ExitMigrationFailed = 5 // A migration failed
+)
+
+// ExitCode returns the exit code for an error returned by a Runner
+func ExitCode(err error) int {
+	var migrationErr *MigrationError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrLockNotAcquired):
+		return ExitLockNotAcquired
+	case errors.As(err, &migrationErr):
+		return ExitMigrationFailed
+	}
+	return ExitFailure
+}
+
+// Result is printed by the run, rollback and status commands with
+// --output json
+type Result struct {
+	Applied    []string          `json:"applied,omitempty"`     // Versions applied by run
+	RolledBack []string          `json:"rolled_back,omitempty"` // Versions rolled back by rollback
+	Migrations []MigrationStatus `json:"migrations,omitempty"`  // Reported by status
+	Error      string            `json:"error,omitempty"`
+	ExitCode   int               `json:"exit_code"`
+}
+
+// exit is replaced in tests
+var exit = os.Exit
+
+// AddRunnerCommands adds the run, rollback and status commands to root, which
+// call runner once they need it
+func AddRunnerCommands(root *cobra.Command, runner func() (*Runner, error)) {
+	var phase string
 	cmdRun := &cobra.Command{
 		Use:   "run",
 		Short: "run all pending migrations",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := runner.Run(); err != nil {
-				log.Fatal(err)
+			result := &Result{}
+			r, err := runner()
+			if err == nil {
+				result.Applied, err = trackChanges(r, func() error {
+					return r.RunPhase(phase)
+				})
 			}
+			finish(cmd, result, err, 0)
 		},
 	}
+	cmdRun.Flags().StringVar(&phase, "phase", "", "only run migrations of this phase (pre or post)")
 
 	cmdRollback := &cobra.Command{
 		Use:   "rollback",
 		Short: "rollback the most recent migration",
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := runner.Rollback(); err != nil {
-				log.Fatal(err)
+			result := &Result{}
+			r, err := runner()
+			if err == nil {
+				result.RolledBack, err = trackChanges(r, r.Rollback)
 			}
+			finish(cmd, result, err, 0)
 		},
 	}
 
-	cmdRoot.AddCommand(cmdNew)
-	cmdRoot.AddCommand(cmdRun)
-	cmdRoot.AddCommand(cmdRollback)
+	var exitCode bool
+	cmdStatus := &cobra.Command{
+		Use:   "status",
+		Short: "show which migrations are pending",
+		Run: func(cmd *cobra.Command, args []string) {
+			result := &Result{}
+			r, err := runner()
+			if err == nil {
+				result.Migrations, err = r.Status()
+			}
+			code := 0
+			if err == nil && exitCode {
+				code = statusExitCode(result.Migrations)
+			}
+			if err == nil && outputFormat(cmd) != "json" {
+				PrintStatus(cmd.OutOrStdout(), result.Migrations)
+			}
+			finish(cmd, result, err, code)
+		},
+	}
+	cmdStatus.Flags().BoolVar(&exitCode, "exit-code", false, "exit with 2 when migrations are pending, or 3 when applied migrations aren't known")
 
-	return cmdRoot
+	for _, cmd := range []*cobra.Command{cmdRun, cmdRollback, cmdStatus} {
+		cmd.Flags().StringP("output", "o", "text", "output format: text or json")
+		cmd.PreRunE = checkOutputFormat
+		root.AddCommand(cmd)
+	}
+}
+
+// checkOutputFormat rejects an unknown --output before the command runs any
+// migration
+func checkOutputFormat(cmd *cobra.Command, args []string) error {
+	if format := outputFormat(cmd); format != "text" && format != "json" {
+		return fmt.Errorf("Unknown output format %q", format)
+	}
+	return nil
+}
+
+// trackChanges runs f and returns the versions it applied or rolled back
+func trackChanges(r *Runner, f func() error) ([]string, error) {
+	before, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	err = f()
+	changed := []string{}
+	for _, s := range before {
+		if !s.Unknown && s.Applied != r.HasVersion(s.Version) {
+			changed = append(changed, s.Version)
+		}
+	}
+	return changed, err
+}
+
+func statusExitCode(statuses []MigrationStatus) int {
+	code := 0
+	for _, s := range statuses {
+		switch {
+		case s.Unknown:
+			return ExitDrift
+		case !s.Applied:
+			code = ExitPending
+		}
+	}
+	return code
+}
+
+func outputFormat(cmd *cobra.Command) string {
+	format, _ := cmd.Flags().GetString("output")
+	return format
+}
+
+// finish prints the result in the requested format and exits with code, or
+// with the code of err
+func finish(cmd *cobra.Command, result *Result, err error, code int) {
+	format := outputFormat(cmd)
+	if err != nil {
+		code = ExitCode(err)
+		result.Error = err.Error()
+	}
+	result.ExitCode = code
+
+	if format == "json" {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(result); encErr != nil && code == 0 {
+			code = ExitFailure
+		}
+	} else if err != nil {
+		log.Print(err)
+	}
+	if code != 0 {
+		exit(code)
+	}
+}
+
+// PrintStatus writes the statuses in the format of the status command
+func PrintStatus(out io.Writer, statuses []MigrationStatus) {
+	outstanding := []string{}
+	unknown := []string{}
+	for _, s := range statuses {
+		state := "applied"
+		switch {
+		case s.Unknown:
+			state = "unknown"
+			unknown = append(unknown, s.Version)
+		case !s.Applied:
+			state = "pending"
+			if !contains(outstanding, s.Phase) {
+				outstanding = append(outstanding, s.Phase)
+			}
+		}
+		fmt.Fprintf(out, "%-8s %-5s %s\n", state, s.Phase, s.Version)
+	}
+	if len(unknown) > 0 {
+		fmt.Fprintf(out, "Applied, but not in the list: %s\n", strings.Join(unknown, ", "))
+	}
+	if len(outstanding) == 0 {
+		fmt.Fprintln(out, "No pending migrations")
+		return
+	}
+	fmt.Fprintf(out, "Pending phases: %s\n", strings.Join(outstanding, ", "))
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
 }
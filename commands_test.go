@@ -0,0 +1,171 @@
+package nomad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+)
+
+// versionStore is a VersionStore that can hold a lock
+type versionStore struct {
+	versions map[string]bool
+	locked   bool
+}
+
+func (vs *versionStore) AddVersion(v string) error    { vs.versions[v] = true; return nil }
+func (vs *versionStore) RemoveVersion(v string) error { delete(vs.versions, v); return nil }
+func (vs *versionStore) HasVersion(v string) bool     { return vs.versions[v] }
+func (vs *versionStore) SetupVersionStore() error     { return nil }
+
+func (vs *versionStore) Versions() ([]string, error) {
+	versions := []string{}
+	for v := range vs.versions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+func (vs *versionStore) Lock() error {
+	if vs.locked {
+		return ErrLockNotAcquired
+	}
+	return nil
+}
+
+func (vs *versionStore) Unlock() error { return nil }
+
+// execute runs the migration command and returns its output and exit code
+func execute(t *testing.T, runner *Runner, args ...string) (*Result, int) {
+	code := 0
+	defer func(orig func(int)) { exit = orig }(exit)
+	exit = func(c int) { code = c }
+
+	var out bytes.Buffer
+	cmd := NewMigrationCmd(runner, t.TempDir())
+	cmd.SetOut(&out)
+	cmd.SetArgs(append(args, "--output", "json"))
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	result := &Result{}
+	if err := json.Unmarshal(out.Bytes(), result); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", out.String(), err)
+	}
+	if result.ExitCode != code {
+		t.Fatalf("Exited with %d, but the output says %d", code, result.ExitCode)
+	}
+	return result, code
+}
+
+func newTestRunner(failing string) (*Runner, *versionStore) {
+	l := NewList()
+	for _, v := range []string{"A", "B"} {
+		version := v
+		l.Add(&Migration{
+			Version: version,
+			Up: func(ctx interface{}) error {
+				if version == failing {
+					return errors.New("Oh no")
+				}
+				return nil
+			},
+			Down: func(ctx interface{}) error { return nil },
+		})
+	}
+	vs := &versionStore{versions: map[string]bool{}}
+	return NewRunner(vs, l, nil), vs
+}
+
+func TestRunCmd_JSON(t *testing.T) {
+	runner, _ := newTestRunner("")
+	result, code := execute(t, runner, "run")
+	if code != 0 || len(result.Applied) != 2 || result.Applied[1] != "B" {
+		t.Fatalf("Expected A and B to be applied, got %+v", result)
+	}
+
+	result, code = execute(t, runner, "rollback")
+	if code != 0 || len(result.RolledBack) != 1 || result.RolledBack[0] != "B" {
+		t.Fatalf("Expected B to be rolled back, got %+v", result)
+	}
+}
+
+func TestRunCmd_MigrationFailed(t *testing.T) {
+	runner, _ := newTestRunner("B")
+	result, code := execute(t, runner, "run")
+	if code != ExitMigrationFailed || result.Error != "Oh no" {
+		t.Fatalf("Expected the migration to fail, got %d %+v", code, result)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "A" {
+		t.Fatalf("Expected A to be applied, got %+v", result.Applied)
+	}
+}
+
+func TestRunCmd_LockNotAcquired(t *testing.T) {
+	runner, vs := newTestRunner("")
+	vs.locked = true
+	result, code := execute(t, runner, "run")
+	if code != ExitLockNotAcquired || len(result.Applied) != 0 {
+		t.Fatalf("Expected the lock to stop the run, got %d %+v", code, result)
+	}
+}
+
+func TestRunCmd_UnknownOutputFormat(t *testing.T) {
+	runner, vs := newTestRunner("")
+	var out bytes.Buffer
+	cmd := NewMigrationCmd(runner, t.TempDir())
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{"run", "-o", "xml"})
+	err := cmd.Execute()
+	if err == nil || err.Error() != `Unknown output format "xml"` {
+		t.Fatalf("Expected the format to be rejected, got %v", err)
+	}
+	if len(vs.versions) != 0 {
+		t.Fatalf("Expected nothing to be applied, got %v", vs.versions)
+	}
+}
+
+func TestStatusCmd_ExitCode(t *testing.T) {
+	runner, vs := newTestRunner("")
+	if _, code := execute(t, runner, "status"); code != 0 {
+		t.Fatalf("Expected status to succeed without --exit-code, got %d", code)
+	}
+	if _, code := execute(t, runner, "status", "--exit-code"); code != ExitPending {
+		t.Fatalf("Expected %d for pending migrations, got %d", ExitPending, code)
+	}
+
+	vs.versions = map[string]bool{"A": true, "B": true}
+	if _, code := execute(t, runner, "status", "--exit-code"); code != 0 {
+		t.Fatalf("Expected 0 without pending migrations, got %d", code)
+	}
+
+	vs.versions["C"] = true
+	result, code := execute(t, runner, "status", "--exit-code")
+	if code != ExitDrift {
+		t.Fatalf("Expected %d for drift, got %d", ExitDrift, code)
+	}
+	last := result.Migrations[len(result.Migrations)-1]
+	if last.Version != "C" || !last.Unknown {
+		t.Fatalf("Expected C to be unknown, got %+v", result.Migrations)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{errors.New("connection refused"), ExitFailure},
+		{ErrLockNotAcquired, ExitLockNotAcquired},
+		{&MigrationError{Version: "A", Err: errors.New("Oh no")}, ExitMigrationFailed},
+	}
+	for _, test := range tests {
+		if code := ExitCode(test.err); code != test.code {
+			t.Errorf("Expected %d for %v, got %d", test.code, test.err, code)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Migrates structured documents, e.g. JSON or YAML config files. Every
+// document stores its own version, so each one is upgraded from wherever it
+// is.
+package document
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Document is a decoded JSON or YAML file. Files ending in .yml or .yaml are
+// YAML, all others JSON. Rewriting a document keeps its data, but not its
+// formatting, key order or comments.
+type Document struct {
+	Path string
+	Data map[string]interface{}
+
+	orig []byte
+}
+
+// Load reads and decodes the document at path
+func Load(path string) (*Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Document{Path: path, orig: data}
+	if d.isYAML() {
+		tree := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		d.Data = normalize(tree).(map[string]interface{})
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		// Numbers stay exactly as they were
+		dec.UseNumber()
+		if err := dec.Decode(&d.Data); err != nil {
+			return nil, err
+		}
+	}
+	if d.Data == nil {
+		d.Data = map[string]interface{}{}
+	}
+	return d, nil
+}
+
+func (d *Document) isYAML() bool {
+	ext := strings.ToLower(filepath.Ext(d.Path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// normalize turns the map[interface{}]interface{} of YAML into
+// map[string]interface{}, so migrations handle JSON and YAML alike
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = normalize(x)
+		}
+		return m
+	case map[string]interface{}:
+		for k, x := range v {
+			v[k] = normalize(x)
+		}
+		return v
+	case []interface{}:
+		for i, x := range v {
+			v[i] = normalize(x)
+		}
+		return v
+	}
+	return v
+}
+
+// Encode returns the document in the format of its file
+func (d *Document) Encode() ([]byte, error) {
+	if d.isYAML() {
+		return yaml.Marshal(d.Data)
+	}
+	data, err := json.MarshalIndent(d.Data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Get returns the value at a dotted path, e.g. "spec.replicas". Keys that
+// contain dots can only be reached through Data.
+func (d *Document) Get(path string) (interface{}, bool) {
+	parent, key := d.parent(path, false)
+	if parent == nil {
+		return nil, false
+	}
+	v, ok := parent[key]
+	return v, ok
+}
+
+// Set sets the value at a dotted path, creating the objects along it
+func (d *Document) Set(path string, v interface{}) error {
+	parent, key := d.parent(path, true)
+	if parent == nil {
+		return fmt.Errorf("Can't set %q, it's inside a value that isn't an object", path)
+	}
+	parent[key] = v
+	return nil
+}
+
+// Delete removes the value at a dotted path and reports whether it existed
+func (d *Document) Delete(path string) bool {
+	parent, key := d.parent(path, false)
+	if parent == nil {
+		return false
+	}
+	_, ok := parent[key]
+	delete(parent, key)
+	return ok
+}
+
+// Rename moves the value at from to to, and reports whether there was one
+func (d *Document) Rename(from, to string) (bool, error) {
+	v, ok := d.Get(from)
+	if !ok {
+		return false, nil
+	}
+	if err := d.Set(to, v); err != nil {
+		return false, err
+	}
+	d.Delete(from)
+	return true, nil
+}
+
+// parent returns the object that holds the last key of path, or nil if there
+// is none
+func (d *Document) parent(path string, create bool) (map[string]interface{}, string) {
+	keys := strings.Split(path, ".")
+	m := d.Data
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k]
+		if !ok && create {
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		m = child
+	}
+	return m, keys[len(keys)-1]
+}
+
+// Save writes the document, replacing its file with a rename
+func (d *Document) Save() error {
+	data, err := d.Encode()
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(d.Path, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d.orig = data
+	return nil
+}
+
+// writeTemp writes data to a temporary file next to path, with the same
+// permissions
+func writeTemp(path string, data []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
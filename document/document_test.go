@@ -0,0 +1,287 @@
+package document
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcls/nomad"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// migrations renames replicas to spec.replicas in A and adds spec.image in B
+func migrations() *nomad.List {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			return ctx.(*Context).Set("spec.image", "nginx")
+		},
+		Down: func(ctx interface{}) error {
+			ctx.(*Context).Delete("spec.image")
+			return nil
+		},
+	})
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Rename("replicas", "spec.replicas")
+			return err
+		},
+		Down: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Rename("spec.replicas", "replicas")
+			return err
+		},
+	})
+	return l
+}
+
+func TestDocumentHelpers(t *testing.T) {
+	d := &Document{Data: map[string]interface{}{"a": map[string]interface{}{"b": 1}, "c": "x"}}
+	if v, ok := d.Get("a.b"); !ok || v != 1 {
+		t.Fatalf("Get(a.b) = %v, %v", v, ok)
+	}
+	if _, ok := d.Get("c.d"); ok {
+		t.Fatal("c isn't an object")
+	}
+	if err := d.Set("c.d", 1); err == nil {
+		t.Fatal("Expected error setting inside a string")
+	}
+	if err := d.Set("e.f.g", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := d.Get("e.f.g"); v != 2 {
+		t.Fatalf("Set didn't create the objects: %v", d.Data)
+	}
+	if ok, err := d.Rename("a.b", "h"); !ok || err != nil {
+		t.Fatalf("Rename = %v, %v", ok, err)
+	}
+	if _, ok := d.Get("a.b"); ok || d.Data["h"] != 1 {
+		t.Fatalf("Rename didn't move the value: %v", d.Data)
+	}
+	if !d.Delete("h") || d.Delete("h") {
+		t.Fatal("Delete should only report existing values")
+	}
+}
+
+func TestRunner_StoresVersionInDocument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.yml")
+	writeFile(t, path, "replicas: 3\n")
+	doc, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := migrations()
+	runner := NewRunner(doc, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := doc.Get(DefaultVersionField); v != "B" {
+		t.Fatalf("Expected version B, got %v", v)
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Versions before the document's should count as applied")
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc.Get(DefaultVersionField); ok {
+		t.Fatal("Rolling back the first migration should remove the version")
+	}
+	if v, _ := doc.Get("replicas"); v != 3 {
+		t.Fatalf("Expected replicas to be moved back: %v", doc.Data)
+	}
+}
+
+func TestRunner_NumericVersions(t *testing.T) {
+	up := func(ctx interface{}) error {
+		c := ctx.(*Context)
+		return c.Set("migrated", c.Migration.Version)
+	}
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "9", Up: up})
+	l.Add(&nomad.Migration{Version: "10", Up: up})
+
+	for name, content := range map[string]string{
+		"app.json": `{"schemaVersion": 9}`,
+		"app.yml":  "schemaVersion: 9\n",
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		writeFile(t, path, content)
+		doc, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runner := NewRunner(doc, l)
+		if !runner.HasVersion("9") || runner.HasVersion("10") {
+			t.Fatalf("%s: Expected 10 to come after 9", name)
+		}
+		if err := runner.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := doc.Get("migrated"); v != "10" {
+			t.Fatalf("%s: Expected only 10 to run, got %v", name, v)
+		}
+		if err := doc.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if data := readFile(t, path); !strings.Contains(data, `"schemaVersion": 10`) && !strings.Contains(data, "schemaVersion: 10\n") {
+			t.Fatalf("%s: Expected the version to stay a number:\n%s", name, data)
+		}
+	}
+}
+
+func TestMigrateDir_NumericOrder(t *testing.T) {
+	ran := []string{}
+	l := nomad.NewList()
+	for _, v := range []string{"10", "2", "9"} {
+		l.Add(&nomad.Migration{
+			Version: v,
+			Up: func(interface{}) error {
+				ran = append(ran, "up "+v)
+				return nil
+			},
+			Down: func(interface{}) error {
+				ran = append(ran, "down "+v)
+				return nil
+			},
+		})
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.yml")
+	writeFile(t, path, "schemaVersion: 1\n")
+	if _, err := MigrateDir(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RollbackDir(dir, l); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ran, ", "); got != "up 2, up 9, up 10, down 10" {
+		t.Fatalf("Wrong order: %s", got)
+	}
+	if data := readFile(t, path); data != "schemaVersion: 9\n" {
+		t.Fatalf("Expected version 9 after the rollback:\n%s", data)
+	}
+}
+
+func TestRunner_RestoresFailedMigration(t *testing.T) {
+	doc := &Document{Path: "app.json", Data: map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": 3},
+	}}
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			c.Delete("spec.replicas")
+			if err := c.Set("spec.image", "nginx"); err != nil {
+				return err
+			}
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(doc, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected the migration to fail")
+	}
+	if v, _ := doc.Get("spec.replicas"); v != 3 {
+		t.Fatalf("Expected replicas to be restored: %v", doc.Data)
+	}
+	if _, ok := doc.Get("spec.image"); ok {
+		t.Fatalf("Expected the image to be undone: %v", doc.Data)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Shouldn't have version A")
+	}
+}
+
+func TestMigrateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "old.json"), `{"replicas": 12345678901234567890}`)
+	writeFile(t, filepath.Join(dir, "nested", "half.yaml"), "schemaVersion: A\nspec:\n  replicas: 2\n")
+	writeFile(t, filepath.Join(dir, "current.json"), `{"schemaVersion": "B", "spec": {"replicas": 1, "image": "redis"}}`)
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not a document")
+
+	changed, err := MigrateDir(dir, migrations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 {
+		t.Fatalf("Expected 2 rewritten documents, got %v", changed)
+	}
+
+	old := readFile(t, filepath.Join(dir, "old.json"))
+	if !strings.Contains(old, `"replicas": 12345678901234567890`) || !strings.Contains(old, `"schemaVersion": "B"`) {
+		t.Fatalf("Wrong migrated document:\n%s", old)
+	}
+	half, err := Load(filepath.Join(dir, "nested", "half.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := half.Get("spec.image"); v != "nginx" {
+		t.Fatalf("Expected B to be applied:\n%v", half.Data)
+	}
+	if v, _ := half.Get("spec.replicas"); v != 2 {
+		t.Fatalf("A shouldn't have run again:\n%v", half.Data)
+	}
+	if !strings.Contains(readFile(t, filepath.Join(dir, "current.json")), "redis") {
+		t.Fatal("The up to date document shouldn't change")
+	}
+}
+
+func TestMigrateDir_AllOrNone(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.json"), `{"replicas": 1}`)
+	writeFile(t, filepath.Join(dir, "b.json"), `{"replicas": "broken"}`)
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if v, _ := c.Get("replicas"); v == "broken" {
+				return errors.New("Oh no")
+			}
+			return c.Set("replicas", 2)
+		},
+	})
+
+	if _, err := MigrateDir(dir, l); err == nil || !strings.Contains(err.Error(), "b.json") {
+		t.Fatalf("Expected the error of b.json, got %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.json")); got != `{"replicas": 1}` {
+		t.Fatalf("a.json shouldn't have been rewritten:\n%s", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the temporary files to be removed, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,306 @@
+package document
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mcls/nomad"
+)
+
+// DefaultVersionField holds the version of a document, unless
+// VersionStore.Field is set
+const DefaultVersionField = "schemaVersion"
+
+// Context is passed to every migration, which changes the document in place
+type Context struct {
+	*Document
+	Migration *nomad.Migration // Migration that's currently running
+	Direction nomad.Direction
+
+	snapshot map[string]interface{} // Data before the migration, see NewHooks
+}
+
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+	c.Direction = d
+}
+
+// NewRunner creates a nomad.Runner that migrates a single document in memory.
+// Call Save on the document to write it. The list is ordered like the
+// VersionStore compares versions, so 10 runs after 9.
+func NewRunner(doc *Document, list *nomad.List) *nomad.Runner {
+	list.Compare = compareVersions
+	vs := &VersionStore{Doc: doc, list: list}
+	return nomad.NewRunner(vs, list, &Context{Document: doc}, NewHooks())
+}
+
+// NewHooks creates the hooks that undo a failed migration. The data of the
+// document is copied before every migration and put back when it fails, so
+// the document keeps the migrations before it, but none of the failed one's
+// changes.
+func NewHooks() *nomad.Hooks {
+	return &nomad.Hooks{
+		Before: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			c.snapshot = deepCopy(c.Data).(map[string]interface{})
+			return nil
+		},
+		After: func(ctx interface{}) error {
+			ctx.(*Context).snapshot = nil
+			return nil
+		},
+		OnError: func(ctx interface{}, err error) error {
+			c := ctx.(*Context)
+			if c.snapshot != nil {
+				c.Data, c.snapshot = c.snapshot, nil
+			}
+			return err
+		},
+	}
+}
+
+// deepCopy copies the maps and slices of decoded data. Other values are
+// immutable.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[k] = deepCopy(x)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, x := range v {
+			s[i] = deepCopy(x)
+		}
+		return s
+	}
+	return v
+}
+
+// VersionStore stores the version of the last applied migration in a field
+// of the document. All versions up to it count as applied. Versions are
+// compared as numbers when both are numeric, so 10 comes after 9, and as
+// strings otherwise.
+type VersionStore struct {
+	Doc *Document
+	// Field holds the version, DefaultVersionField if empty. It's a dotted
+	// path, like the ones of Document.Get.
+	Field string
+
+	list *nomad.List
+}
+
+func (vs *VersionStore) field() string {
+	if vs.Field == "" {
+		return DefaultVersionField
+	}
+	return vs.Field
+}
+
+// version returns the version of the document, or "" if it has none
+func (vs *VersionStore) version() string {
+	v, ok := vs.Doc.Get(vs.field())
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	current := vs.version()
+	return current != "" && compareVersions(v, current) <= 0
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	if current := vs.version(); current != "" && compareVersions(v, current) <= 0 {
+		return nil
+	}
+	return vs.setVersion(v)
+}
+
+// RemoveVersion sets the version of the document to the one of the migration
+// before v, or removes it when v was the first one
+func (vs *VersionStore) RemoveVersion(v string) error {
+	previous := ""
+	for i := 0; i < vs.list.Len(); i++ {
+		x := vs.list.Get(i).Version
+		if compareVersions(x, v) < 0 && (previous == "" || compareVersions(x, previous) > 0) {
+			previous = x
+		}
+	}
+	if previous == "" {
+		vs.Doc.Delete(vs.field())
+		return nil
+	}
+	return vs.setVersion(previous)
+}
+
+// setVersion writes v with the type the field has, so a numeric version stays
+// a number
+func (vs *VersionStore) setVersion(v string) error {
+	current, _ := vs.Doc.Get(vs.field())
+	switch current.(type) {
+	case json.Number, int, int64, uint64, float64:
+		n, ok := parseNumber(v)
+		if !ok {
+			break
+		}
+		var value interface{}
+		if n.IsInt() && n.Num().IsInt64() {
+			value = int(n.Num().Int64())
+		} else {
+			value, _ = n.Float64()
+		}
+		if _, ok := current.(json.Number); ok {
+			value = json.Number(fmt.Sprint(value))
+		}
+		return vs.Doc.Set(vs.field(), value)
+	}
+	return vs.Doc.Set(vs.field(), v)
+}
+
+// compareVersions returns -1, 0 or 1 when a comes before, is the same as or
+// comes after b
+func compareVersions(a, b string) int {
+	x, xok := parseNumber(a)
+	y, yok := parseNumber(b)
+	if xok && yok {
+		return x.Cmp(y)
+	}
+	return strings.Compare(a, b)
+}
+
+func parseNumber(v string) (*big.Rat, bool) {
+	if strings.Contains(v, "/") {
+		return nil, false
+	}
+	return new(big.Rat).SetString(v)
+}
+
+func (vs *VersionStore) SetupVersionStore() error {
+	return nil
+}
+
+// MigrateDir runs the pending migrations of every document in dir and its
+// subdirectories, and returns the paths of the rewritten ones. See
+// migrateDir for how it's done transactionally.
+func MigrateDir(dir string, list *nomad.List) ([]string, error) {
+	return migrateDir(dir, list, (*nomad.Runner).Run)
+}
+
+// RollbackDir rolls back the last applied migration of every document in dir
+// and its subdirectories, like MigrateDir
+func RollbackDir(dir string, list *nomad.List) ([]string, error) {
+	return migrateDir(dir, list, (*nomad.Runner).Rollback)
+}
+
+// migrateDir migrates every document in memory first, so a failing one stops
+// the upgrade before anything is written. The changed documents are written
+// to temporary files, which then replace them. If replacing a file fails, the
+// files that were already replaced get their original content back, so
+// either all documents are rewritten or none.
+func migrateDir(dir string, list *nomad.List, migrate func(*nomad.Runner) error) ([]string, error) {
+	docs, err := loadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []*Document{}
+	staged := []string{}
+	defer func() {
+		for _, tmp := range staged {
+			os.Remove(tmp)
+		}
+	}()
+	for _, doc := range docs {
+		// Documents that no migration changed keep their formatting
+		before, err := doc.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", doc.Path, err)
+		}
+		if err := migrate(NewRunner(doc, list)); err != nil {
+			return nil, fmt.Errorf("%s: %w", doc.Path, err)
+		}
+		data, err := doc.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", doc.Path, err)
+		}
+		if string(data) == string(before) {
+			continue
+		}
+		tmp, err := writeTemp(doc.Path, data)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, doc)
+		staged = append(staged, tmp)
+	}
+
+	paths := []string{}
+	for i, doc := range changed {
+		if err := os.Rename(staged[i], doc.Path); err != nil {
+			restore(changed[:i])
+			return nil, err
+		}
+		paths = append(paths, doc.Path)
+	}
+	for _, doc := range changed {
+		doc.orig, _ = doc.Encode()
+	}
+	return paths, nil
+}
+
+// restore writes back the original content of documents
+func restore(docs []*Document) {
+	for _, doc := range docs {
+		tmp, err := writeTemp(doc.Path, doc.orig)
+		if err == nil {
+			err = os.Rename(tmp, doc.Path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			log.Printf("Couldn't restore %s: %s\n", doc.Path, err)
+		}
+	}
+}
+
+// loadDir loads the JSON and YAML documents in dir and its subdirectories.
+// Hidden files and directories are skipped.
+func loadDir(dir string) ([]*Document, error) {
+	docs := []*Document{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json", ".yml", ".yaml":
+		default:
+			return nil
+		}
+		doc, err := Load(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	return docs, err
+}
@@ -0,0 +1,251 @@
+// Stores the versions of migrations in a JSON or YAML file, so nomad can
+// version things that aren't databases, e.g. config directories or caches
+package filestore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcls/nomad"
+	"gopkg.in/yaml.v2"
+)
+
+// NewRunner creates a nomad.Runner that stores its versions in the file at
+// path. Migrations get ctx as their context.
+func NewRunner(path string, list *nomad.List, ctx interface{}) *nomad.Runner {
+	return nomad.NewRunner(NewVersionStore(path), list, ctx)
+}
+
+// Record is stored for every applied version
+type Record struct {
+	Version   string            `json:"version" yaml:"version"`
+	AppliedAt time.Time         `json:"applied_at" yaml:"applied_at"`
+	Metadata  map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// file is the content of the version file
+type file struct {
+	Versions []Record `json:"versions" yaml:"versions"`
+}
+
+// VersionStore stores the versions in the file at Path. Files ending in .yml
+// or .yaml are written as YAML, all others as JSON. Every change replaces the
+// file with a rename, so it's never left half written.
+type VersionStore struct {
+	Path string
+	// Metadata, if set, returns the metadata stored with a version when it's
+	// applied
+	Metadata func(version string) map[string]string
+
+	lockFile *os.File
+}
+
+func NewVersionStore(path string) *VersionStore {
+	return &VersionStore{Path: path}
+}
+
+func (vs *VersionStore) isYAML() bool {
+	ext := strings.ToLower(filepath.Ext(vs.Path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+func (vs *VersionStore) read() (*file, error) {
+	data, err := os.ReadFile(vs.Path)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{}
+	if vs.isYAML() {
+		err = yaml.UnmarshalStrict(data, f)
+	} else {
+		err = json.Unmarshal(data, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// write replaces the file with a temporary one, which is synced first so the
+// rename never exposes a partial file
+func (vs *VersionStore) write(f *file) error {
+	var data []byte
+	var err error
+	if vs.isYAML() {
+		data, err = yaml.Marshal(f)
+	} else {
+		data, err = json.MarshalIndent(f, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(vs.Path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(vs.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), vs.Path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes the rename durable. Not every platform can sync directories,
+// so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func (vs *VersionStore) update(change func(f *file)) error {
+	f, err := vs.read()
+	if err != nil {
+		return err
+	}
+	change(f)
+	return vs.write(f)
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	record := Record{Version: v, AppliedAt: time.Now().UTC().Truncate(time.Second)}
+	if vs.Metadata != nil {
+		record.Metadata = vs.Metadata(v)
+	}
+	return vs.update(func(f *file) {
+		f.Versions = append(removeVersion(f.Versions, v), record)
+		sort.Slice(f.Versions, func(i, j int) bool {
+			return f.Versions[i].Version < f.Versions[j].Version
+		})
+	})
+}
+
+func (vs *VersionStore) RemoveVersion(v string) error {
+	return vs.update(func(f *file) {
+		f.Versions = removeVersion(f.Versions, v)
+	})
+}
+
+func removeVersion(records []Record, v string) []Record {
+	kept := []Record{}
+	for _, r := range records {
+		if r.Version != v {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	_, ok, err := vs.Record(v)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// SetupVersionStore creates the file, and its directory, unless it exists
+func (vs *VersionStore) SetupVersionStore() error {
+	if _, err := os.Stat(vs.Path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vs.Path), 0755); err != nil {
+		return err
+	}
+	return vs.write(&file{Versions: []Record{}})
+}
+
+// Record returns the record of an applied version
+func (vs *VersionStore) Record(v string) (Record, bool, error) {
+	f, err := vs.read()
+	if err != nil {
+		return Record{}, false, err
+	}
+	for _, r := range f.Versions {
+		if r.Version == v {
+			return r, true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+// Records returns the records of the applied versions, in order
+func (vs *VersionStore) Records() ([]Record, error) {
+	f, err := vs.read()
+	if err != nil {
+		return nil, err
+	}
+	return f.Versions, nil
+}
+
+// Versions returns the applied versions, in order
+func (vs *VersionStore) Versions() ([]string, error) {
+	records, err := vs.Records()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(records))
+	for _, r := range records {
+		versions = append(versions, r.Version)
+	}
+	return versions, nil
+}
+
+// Lock implements nomad.Locker by locking Path with ".lock" appended, which
+// the operating system releases when the process dies
+func (vs *VersionStore) Lock() error {
+	if err := os.MkdirAll(filepath.Dir(vs.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(vs.Path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	vs.lockFile = f
+	return nil
+}
+
+// Unlock releases the lock acquired by Lock. The lock file is left behind, as
+// removing it could let two runs lock different files.
+func (vs *VersionStore) Unlock() error {
+	if vs.lockFile == nil {
+		return nil
+	}
+	f := vs.lockFile
+	vs.lockFile = nil
+	if err := unlockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,142 @@
+package filestore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcls/nomad"
+)
+
+func TestImplementsInterfaces(t *testing.T) {
+	var _ nomad.VersionStore = NewVersionStore("")
+	var _ nomad.VersionLister = NewVersionStore("")
+	var _ nomad.Locker = NewVersionStore("")
+}
+
+func TestRunAndRollback(t *testing.T) {
+	for _, name := range []string{"versions.json", "versions.yml"} {
+		path := filepath.Join(t.TempDir(), "state", name)
+		applied := []string{}
+		l := nomad.NewList()
+		for _, v := range []string{"A", "B"} {
+			v := v
+			l.Add(&nomad.Migration{
+				Version: v,
+				Up: func(ctx interface{}) error {
+					applied = append(applied, v)
+					return nil
+				},
+				Down: func(ctx interface{}) error { return nil },
+			})
+		}
+
+		runner := NewRunner(path, l, nil)
+		runner.VersionStore.(*VersionStore).Metadata = func(v string) map[string]string {
+			return map[string]string{"host": "test"}
+		}
+		if err := runner.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := runner.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A new store reads the state back from the file
+		vs := NewVersionStore(path)
+		if !vs.HasVersion("A") || vs.HasVersion("B") {
+			t.Fatalf("%s: Expected only A to be applied", name)
+		}
+		record, ok, err := vs.Record("A")
+		if err != nil || !ok {
+			t.Fatalf("%s: Expected a record for A: %v", name, err)
+		}
+		if record.AppliedAt.IsZero() || record.Metadata["host"] != "test" {
+			t.Fatalf("%s: Wrong record: %#v", name, record)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, ".yml") != strings.Contains(string(data), "versions:\n") {
+			t.Fatalf("%s: Wrong format:\n%s", name, data)
+		}
+	}
+}
+
+func TestWriteLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	vs := NewVersionStore(filepath.Join(dir, "versions.json"))
+	if err := vs.SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"B", "A", "C"} {
+		if err := vs.AddVersion(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vs.RemoveVersion("C"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the version file, got %d entries", len(entries))
+	}
+	versions, err := vs.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(versions, ",") != "A,B" {
+		t.Fatalf("Wrong versions: %v", versions)
+	}
+}
+
+func TestSetupKeepsExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.json")
+	vs := NewVersionStore(path)
+	if err := vs.SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.AddVersion("A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVersionStore(path).SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if !vs.HasVersion("A") {
+		t.Fatal("Setup shouldn't reset the file")
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.json")
+	first, second := NewVersionStore(path), NewVersionStore(path)
+
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); !errors.Is(err, nomad.ErrLockNotAcquired) {
+		t.Fatalf("Expected the lock to be held, got %v", err)
+	}
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: func(ctx interface{}) error { return nil }})
+	if err := NewRunner(path, l, nil).Run(); !errors.Is(err, nomad.ErrLockNotAcquired) {
+		t.Fatalf("Expected the run to be locked out, got %v", err)
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
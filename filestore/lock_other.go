@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package filestore
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(f *os.File) error {
+	return errors.New("Locking files isn't supported on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package filestore
+
+import (
+	"errors"
+	"os"
+
+	"github.com/mcls/nomad"
+	"golang.org/x/sys/windows"
+)
+
+func lockFile(f *os.File) error {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return nomad.ErrLockNotAcquired
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -1,6 +1,12 @@
 package inmem
 
-import "github.com/mcls/nomad"
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mcls/nomad"
+)
 
 func NewRunner(list *nomad.List, ctx ...interface{}) *nomad.Runner {
 	runner := nomad.NewRunner(NewMemVersionStore(), list, nil)
@@ -10,36 +16,104 @@ func NewRunner(list *nomad.List, ctx ...interface{}) *nomad.Runner {
 	return runner
 }
 
-// MemVersionStore is a in-memory implementation of VersionStore,
-// only used for tests
+// Record is an applied version
+type Record struct {
+	Version   string
+	AppliedAt time.Time
+}
+
+// MemVersionStore is an in-memory implementation of VersionStore, meant as
+// the reference store in tests of code that drives a Runner. It's safe for
+// concurrent use, and remembers the order and time versions were applied in.
+// The zero value is an empty store.
 type MemVersionStore struct {
-	versions map[string]bool
+	// Now returns the time versions are applied at, time.Now if nil
+	Now func() time.Time
+
+	mu      sync.RWMutex
+	records []Record // In the order they were applied
 }
 
-func NewMemVersionStore() *MemVersionStore {
-	return &MemVersionStore{map[string]bool{}}
+// NewMemVersionStore creates a store in which versions are already applied,
+// in the given order
+func NewMemVersionStore(versions ...string) *MemVersionStore {
+	mv := &MemVersionStore{}
+	for _, v := range versions {
+		mv.AddVersion(v)
+	}
+	return mv
+}
+
+// Seed adds records as if they were applied in the given order, e.g. to set
+// up the state of a test with fixed times. Versions that are already applied
+// are skipped.
+func (mv *MemVersionStore) Seed(records ...Record) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	for _, r := range records {
+		if mv.index(r.Version) < 0 {
+			mv.records = append(mv.records, r)
+		}
+	}
+}
+
+func (mv *MemVersionStore) now() time.Time {
+	if mv.Now != nil {
+		return mv.Now()
+	}
+	return time.Now()
 }
 
-// AddVersion adds the version
+// index returns the index of the version's record, or -1. mu must be held.
+func (mv *MemVersionStore) index(v string) int {
+	for i, r := range mv.records {
+		if r.Version == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddVersion adds the version, unless it's already applied
 func (mv *MemVersionStore) AddVersion(v string) error {
-	mv.versions[v] = true
+	mv.Seed(Record{Version: v, AppliedAt: mv.now()})
 	return nil
 }
 
 func (mv *MemVersionStore) RemoveVersion(v string) error {
-	mv.versions[v] = false
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	if i := mv.index(v); i >= 0 {
+		mv.records = append(mv.records[:i], mv.records[i+1:]...)
+	}
 	return nil
 }
 
 // HasVersion checks if the version already exists
 func (mv *MemVersionStore) HasVersion(v string) bool {
-	return mv.versions[v]
+	mv.mu.RLock()
+	defer mv.mu.RUnlock()
+	return mv.index(v) >= 0
 }
 
 // SetupVersionStore must be ran before checking versions
 func (mv *MemVersionStore) SetupVersionStore() error {
-	if mv.versions == nil {
-		mv.versions = map[string]bool{}
-	}
 	return nil
 }
+
+// Snapshot returns a copy of the records, in the order they were applied
+func (mv *MemVersionStore) Snapshot() []Record {
+	mv.mu.RLock()
+	defer mv.mu.RUnlock()
+	return append([]Record{}, mv.records...)
+}
+
+// Versions returns the applied versions, in order
+func (mv *MemVersionStore) Versions() ([]string, error) {
+	versions := []string{}
+	for _, r := range mv.Snapshot() {
+		versions = append(versions, r.Version)
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
@@ -2,7 +2,11 @@ package inmem
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mcls/nomad"
 )
@@ -229,3 +233,514 @@ func TestRollback_WithErrors(t *testing.T) {
 		t.Fatal("Shouldn't have removed 'A' after error")
 	}
 }
+
+type setterContext struct {
+	Versions   []string
+	Directions []nomad.Direction
+}
+
+func (c *setterContext) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Versions = append(c.Versions, m.Version)
+	c.Directions = append(c.Directions, d)
+}
+
+func TestRun_SetsMigrationOnContext(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: func(ctx interface{}) error { return nil }})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up:      func(ctx interface{}) error { return nil },
+		Down:    func(ctx interface{}) error { return nil },
+	})
+
+	c := &setterContext{}
+	runner := NewRunner(l, c)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"A", "B", "B"}
+	for i, v := range want {
+		if c.Versions[i] != v {
+			t.Fatalf("Expected versions %q, got %q", want, c.Versions)
+		}
+	}
+	if c.Directions[1] != nomad.DirectionUp || c.Directions[2] != nomad.DirectionDown {
+		t.Fatalf("Wrong directions: %v", c.Directions)
+	}
+}
+
+func TestRun_CallsRunHooks(t *testing.T) {
+	calls := []string{}
+	record := func(name string) func(interface{}) error {
+		return func(ctx interface{}) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	hooks := &nomad.Hooks{
+		Before:    record("before"),
+		After:     record("after"),
+		BeforeRun: record("beforeRun"),
+		AfterRun:  record("afterRun"),
+	}
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: func(ctx interface{}) error { return nil }})
+	l.Add(&nomad.Migration{Version: "B", Up: func(ctx interface{}) error { return nil }})
+	runner := nomad.NewRunner(NewMemVersionStore(), l, nil, hooks)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"beforeRun", "before", "after", "before", "after", "afterRun"}
+	if len(calls) != len(want) {
+		t.Fatalf("Expected calls %q, got %q", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("Expected calls %q, got %q", want, calls)
+		}
+	}
+}
+
+func TestRun_SkipsAfterRunOnError(t *testing.T) {
+	afterRun := false
+	hooks := &nomad.Hooks{
+		AfterRun: func(ctx interface{}) error {
+			afterRun = true
+			return nil
+		},
+	}
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			return errors.New("Oh no")
+		},
+	})
+	runner := nomad.NewRunner(NewMemVersionStore(), l, nil, hooks)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if afterRun {
+		t.Fatal("AfterRun shouldn't be called when a migration failed")
+	}
+}
+
+func TestRun_RetriesTransientErrors(t *testing.T) {
+	attempts := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			attempts += 1
+			if attempts < 3 {
+				return errors.New("deadlock")
+			}
+			return nil
+		},
+	})
+
+	retries := []int{}
+	hooks := &nomad.Hooks{
+		OnRetry: func(ctx interface{}, attempt int, err error) error {
+			retries = append(retries, attempt)
+			return nil
+		},
+	}
+	runner := nomad.NewRunner(NewMemVersionStore(), l, nil, hooks)
+	runner.Retry = &nomad.RetryPolicy{MaxAttempts: 5}
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+	if len(retries) != 2 || retries[0] != 2 || retries[1] != 3 {
+		t.Fatalf("OnRetry called with wrong attempts: %v", retries)
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Should have version A")
+	}
+}
+
+func TestRun_GivesUpAfterMaxAttempts(t *testing.T) {
+	attempts := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			attempts += 1
+			return errors.New("deadlock")
+		},
+	})
+
+	runner := NewRunner(l)
+	runner.Retry = &nomad.RetryPolicy{MaxAttempts: 3}
+	if err := runner.Run(); err == nil || err.Error() != "deadlock" {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRun_DoesntRetryPermanentErrors(t *testing.T) {
+	attempts := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			attempts += 1
+			return errors.New("syntax error")
+		},
+	})
+
+	runner := NewRunner(l)
+	runner.Retry = &nomad.RetryPolicy{
+		MaxAttempts: 3,
+		Retryable: func(err error) bool {
+			return err.Error() == "deadlock"
+		},
+	}
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := nomad.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	want := map[int]time.Duration{
+		2: 10 * time.Millisecond,
+		3: 20 * time.Millisecond,
+		4: 40 * time.Millisecond,
+		5: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	}
+	for attempt, d := range want {
+		if got := backoff(attempt); got != d {
+			t.Fatalf("Backoff for attempt %d was %s, want %s", attempt, got, d)
+		}
+	}
+}
+
+func TestRunPhase(t *testing.T) {
+	ran := []string{}
+	up := func(v string) func(interface{}) error {
+		return func(ctx interface{}) error {
+			ran = append(ran, v)
+			return nil
+		}
+	}
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: up("A")})
+	l.Add(&nomad.Migration{Version: "B", Phase: nomad.PhasePost, Up: up("B")})
+	l.Add(&nomad.Migration{Version: "C", Phase: nomad.PhasePre, Up: up("C")})
+	runner := NewRunner(l)
+
+	if err := runner.RunPhase(nomad.PhasePost); err == nil {
+		t.Fatal("Shouldn't run post-deploy migrations while pre-deploy ones are pending")
+	}
+	if len(ran) != 0 {
+		t.Fatalf("Shouldn't have run migrations, ran %q", ran)
+	}
+
+	if err := runner.RunPhase(nomad.PhasePre); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0] != "A" || ran[1] != "C" {
+		t.Fatalf("Expected pre-deploy migrations A and C to run, ran %q", ran)
+	}
+	if runner.HasVersion("B") {
+		t.Fatal("Shouldn't have run post-deploy migration B")
+	}
+
+	if err := runner.RunPhase(nomad.PhasePost); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("B") {
+		t.Fatal("Should have version B")
+	}
+}
+
+func TestRunPhase_Unknown(t *testing.T) {
+	l := nomad.NewList()
+	up := func(ctx interface{}) error { return nil }
+	l.Add(&nomad.Migration{Version: "A", Phase: nomad.PhasePost, Up: up})
+	l.Add(&nomad.Migration{Version: "B", Phase: "cleanup", Up: up})
+	runner := NewRunner(l)
+
+	if err := runner.RunPhase("postt"); err == nil || err.Error() != `Unknown phase "postt"` {
+		t.Fatalf("Expected an unknown phase, got %v", err)
+	}
+	if runner.HasVersion("A") || runner.HasVersion("B") {
+		t.Fatal("Shouldn't have run any migration")
+	}
+	if err := runner.RunPhase("cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("B") {
+		t.Fatal("Should have version B")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "B", Phase: nomad.PhasePost})
+	l.Add(&nomad.Migration{Version: "A"})
+	runner := NewRunner(l)
+	runner.AddVersion("A")
+
+	statuses, err := runner.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []nomad.MigrationStatus{
+		{Version: "A", Phase: nomad.PhasePre, Applied: true},
+		{Version: "B", Phase: nomad.PhasePost, Applied: false},
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, statuses)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, statuses)
+		}
+	}
+}
+
+func TestRun_ChecksDependencies(t *testing.T) {
+	x := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version:   "B",
+		DependsOn: []string{"A"},
+		Up: func(ctx interface{}) error {
+			x += 1
+			return nil
+		},
+	})
+	l.Add(&nomad.Migration{
+		Version:   "C",
+		DependsOn: []string{"D"},
+		Phase:     nomad.PhasePost,
+		Up: func(ctx interface{}) error {
+			x += 1
+			return nil
+		},
+	})
+	l.Add(&nomad.Migration{Version: "D", Phase: nomad.PhasePost})
+	runner := NewRunner(l)
+
+	err := runner.RunPhase(nomad.PhasePre)
+	if err == nil || err.Error() != `Migration "B" depends on "A", which hasn't been applied` {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			x += 1
+			return nil
+		},
+	})
+	if err := runner.RunPhase(nomad.PhasePre); err != nil {
+		t.Fatal(err)
+	}
+	if x != 2 {
+		t.Fatalf("Expected A and B to run. x = %d", x)
+	}
+
+	err = runner.RunPhase(nomad.PhasePost)
+	if err == nil || err.Error() != `Migration "C" depends on "D", which hasn't been applied` {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+	if x != 2 {
+		t.Fatal("Shouldn't run migrations when a dependency is missing")
+	}
+}
+
+func TestLazyMigrationCmd(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: func(ctx interface{}) error { return nil }})
+
+	calls := []nomad.RunnerOptions{}
+	factory := func(opts nomad.RunnerOptions) (*nomad.Runner, error) {
+		calls = append(calls, opts)
+		return NewRunner(l), nil
+	}
+	defaults := nomad.RunnerOptions{DatabaseURL: "mem://default", Dir: t.TempDir()}
+
+	cmd := nomad.NewLazyMigrationCmd(factory, defaults)
+	cmd.SetArgs([]string{"new", "create_users"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatal("Creating a migration shouldn't need the runner")
+	}
+
+	cmd = nomad.NewLazyMigrationCmd(factory, defaults)
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetArgs([]string{"status", "--database-url", "mem://flag"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	want := nomad.RunnerOptions{DatabaseURL: "mem://flag", Dir: defaults.Dir}
+	if len(calls) != 1 || calls[0] != want {
+		t.Fatalf("Expected the factory to be called with %+v, got %+v", want, calls)
+	}
+}
+
+func TestMigrationCmd_NoDatabaseURL(t *testing.T) {
+	cmd := nomad.NewMigrationCmd(NewRunner(nomad.NewList()), t.TempDir())
+	if cmd.PersistentFlags().Lookup("database-url") != nil {
+		t.Fatal("Expected no --database-url flag for a runner that's set up")
+	}
+	cmd.SetOut(ioutil.Discard)
+	cmd.SetErr(ioutil.Discard)
+	cmd.SetArgs([]string{"status", "--database-url", "mem://ignored"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("Expected --database-url to be rejected")
+	}
+}
+
+func TestStatus_ReportsUnknownVersions(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A"})
+	l.Add(&nomad.Migration{Version: "C"})
+	runner := NewRunner(l)
+	runner.AddVersion("A")
+	runner.AddVersion("B")
+
+	statuses, err := runner.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []nomad.MigrationStatus{
+		{Version: "A", Phase: nomad.PhasePre, Applied: true},
+		{Version: "B", Applied: true, Unknown: true},
+		{Version: "C", Phase: nomad.PhasePre, Applied: false},
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, statuses)
+	}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, statuses)
+		}
+	}
+}
+
+func TestRun_WrapsMigrationErrors(t *testing.T) {
+	cause := errors.New("Oh no")
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up:      func(ctx interface{}) error { return cause },
+	})
+
+	err := NewRunner(l).Run()
+	var migrationErr *nomad.MigrationError
+	if !errors.As(err, &migrationErr) || migrationErr.Version != "A" || migrationErr.Direction != nomad.DirectionUp {
+		t.Fatalf("Expected a *MigrationError for A, got %#v", err)
+	}
+	if !errors.Is(err, cause) || err.Error() != "Oh no" {
+		t.Fatalf("Expected the error to wrap its cause, got %v", err)
+	}
+}
+
+func TestMemVersionStore_Snapshot(t *testing.T) {
+	start := time.Date(2015, 11, 28, 9, 0, 0, 0, time.UTC)
+	vs := NewMemVersionStore()
+	vs.Seed(Record{Version: "C", AppliedAt: start})
+	now := start
+	vs.Now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+
+	l := nomad.NewList()
+	for _, v := range []string{"B", "A"} {
+		l.Add(&nomad.Migration{Version: v, Up: func(ctx interface{}) error { return nil }})
+	}
+	if err := nomad.NewRunner(vs, l, nil).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Record{
+		{Version: "C", AppliedAt: start},
+		{Version: "A", AppliedAt: start.Add(time.Minute)},
+		{Version: "B", AppliedAt: start.Add(2 * time.Minute)},
+	}
+	snapshot := vs.Snapshot()
+	if fmt.Sprint(snapshot) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v, got %v", want, snapshot)
+	}
+
+	// Removed versions are gone, not just marked
+	vs.RemoveVersion("A")
+	if vs.HasVersion("A") || len(vs.Snapshot()) != 2 {
+		t.Fatalf("Expected A to be removed, got %v", vs.Snapshot())
+	}
+	versions, _ := vs.Versions()
+	if fmt.Sprint(versions) != "[B C]" {
+		t.Fatalf("Expected sorted versions, got %v", versions)
+	}
+}
+
+func TestMemVersionStore_Seeding(t *testing.T) {
+	vs := NewMemVersionStore("A", "B")
+	l := nomad.NewList()
+	ran := []string{}
+	for _, v := range []string{"A", "B", "C"} {
+		v := v
+		l.Add(&nomad.Migration{Version: v, Up: func(ctx interface{}) error {
+			ran = append(ran, v)
+			return nil
+		}})
+	}
+	if err := nomad.NewRunner(vs, l, nil).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[C]" {
+		t.Fatalf("Only C should have run, ran %v", ran)
+	}
+
+	var zero MemVersionStore
+	zero.AddVersion("A")
+	if !zero.HasVersion("A") {
+		t.Fatal("The zero value should be usable")
+	}
+}
+
+func TestMemVersionStore_Concurrency(t *testing.T) {
+	vs := NewMemVersionStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := fmt.Sprintf("%02d", i)
+			vs.AddVersion(v)
+			vs.HasVersion(v)
+			vs.Snapshot()
+			if i%2 == 1 {
+				vs.RemoveVersion(v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(vs.Snapshot()) != 5 {
+		t.Fatalf("Expected 5 versions, got %v", vs.Snapshot())
+	}
+}
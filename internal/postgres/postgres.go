@@ -0,0 +1,127 @@
+// Holds what the pg and pgx packages share, which only differ in the driver
+// they run postgres migrations with
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+// Timeouts are the lock_timeout and statement_timeout of a transaction. Zero
+// leaves the server's setting alone.
+type Timeouts struct {
+	Lock      time.Duration
+	Statement time.Duration
+}
+
+// Apply applies the timeouts of m to the transaction exec runs statements in,
+// or defaults for the ones m doesn't set. t holds the timeouts that are
+// already applied, so settings of a previous migration in the same
+// transaction are reset to the defaults.
+func (t *Timeouts) Apply(m *nomad.Migration, defaults Timeouts, exec func(query string) error) error {
+	next := defaults
+	if m != nil {
+		if m.LockTimeout > 0 {
+			next.Lock = m.LockTimeout
+		}
+		if m.StatementTimeout > 0 {
+			next.Statement = m.StatementTimeout
+		}
+	}
+	settings := []struct {
+		name           string
+		current, value time.Duration
+	}{
+		{"lock_timeout", t.Lock, next.Lock},
+		{"statement_timeout", t.Statement, next.Statement},
+	}
+	for _, s := range settings {
+		if s.current == s.value {
+			continue
+		}
+		value := "DEFAULT"
+		if s.value > 0 {
+			value = TimeoutValue(s.value)
+		}
+		if err := exec("SET LOCAL " + s.name + " TO " + value); err != nil {
+			return err
+		}
+	}
+	*t = next
+	return nil
+}
+
+// TimeoutError is returned when a migration was canceled because it exceeded
+// its lock_timeout or statement_timeout
+type TimeoutError struct {
+	Version string        // Version of the migration
+	Setting string        // lock_timeout or statement_timeout
+	Timeout time.Duration // Value of the setting
+	Err     error         // Error returned by postgres
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("migration %q exceeded %s of %s: %s", e.Version, e.Setting, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap converts err into a *TimeoutError if it was caused by one of the
+// timeouts, which were applied for m
+func (t Timeouts) Wrap(m *nomad.Migration, err error) error {
+	timeoutErr := &TimeoutError{Err: err}
+	if m != nil {
+		timeoutErr.Version = m.Version
+	}
+	switch code := sqlState(err); {
+	case code == "55P03" && t.Lock > 0:
+		timeoutErr.Setting, timeoutErr.Timeout = "lock_timeout", t.Lock
+	case code == "57014" && t.Statement > 0:
+		timeoutErr.Setting, timeoutErr.Timeout = "statement_timeout", t.Statement
+	default:
+		return err
+	}
+	return timeoutErr
+}
+
+// TimeoutValue formats a timeout for SET in whole milliseconds, rounded up, so
+// a timeout below a millisecond doesn't turn into '0ms', which disables it
+func TimeoutValue(d time.Duration) string {
+	return fmt.Sprintf("'%dms'", (d+time.Millisecond-1)/time.Millisecond)
+}
+
+// sqlState returns the SQLSTATE code of a postgres error, or "" for other
+// errors. The errors of lib/pq and pgx both have one.
+func sqlState(err error) string {
+	var stateErr interface{ SQLState() string }
+	if !errors.As(err, &stateErr) {
+		return ""
+	}
+	return stateErr.SQLState()
+}
+
+// IsTransient reports whether err is a postgres error that's likely to go away
+// when the migration is retried: a serialization failure, a deadlock or a
+// lock that couldn't be acquired in time.
+func IsTransient(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01", "55P03":
+		return true
+	}
+	return false
+}
+
+// NewRetryPolicy creates a policy that retries migrations that failed with a
+// transient error, with exponential backoff between the attempts
+func NewRetryPolicy(maxAttempts int) *nomad.RetryPolicy {
+	return &nomad.RetryPolicy{
+		MaxAttempts: maxAttempts,
+		Backoff:     nomad.ExponentialBackoff(100*time.Millisecond, 5*time.Second),
+		Retryable:   IsTransient,
+	}
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+func TestTimeouts_Apply(t *testing.T) {
+	queries := []string{}
+	exec := func(query string) error {
+		queries = append(queries, query)
+		return nil
+	}
+	defaults := Timeouts{Lock: time.Second}
+
+	var applied Timeouts
+	if err := applied.Apply(&nomad.Migration{StatementTimeout: time.Minute}, defaults, exec); err != nil {
+		t.Fatal(err)
+	}
+	// The next migration in the same transaction gets the defaults back
+	if err := applied.Apply(&nomad.Migration{}, defaults, exec); err != nil {
+		t.Fatal(err)
+	}
+	want := "SET LOCAL lock_timeout TO '1000ms'; SET LOCAL statement_timeout TO '60000ms'; SET LOCAL statement_timeout TO DEFAULT"
+	if got := strings.Join(queries, "; "); got != want {
+		t.Fatalf("Wrong statements: %s", got)
+	}
+	if applied != defaults {
+		t.Fatalf("Expected the defaults to be applied, got %+v", applied)
+	}
+}
+
+func TestTimeoutValue(t *testing.T) {
+	tests := map[time.Duration]string{
+		time.Microsecond:              "'1ms'",
+		time.Millisecond:              "'1ms'",
+		1500 * time.Microsecond:       "'2ms'",
+		5 * time.Second:               "'5000ms'",
+		time.Second + time.Nanosecond: "'1001ms'",
+	}
+	for d, want := range tests {
+		if value := TimeoutValue(d); value != want {
+			t.Errorf("Expected %s for %s, got %s", want, d, value)
+		}
+	}
+}
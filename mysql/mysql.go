@@ -0,0 +1,340 @@
+// Helps with the integration of nomad with MySQL and MariaDB
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/sqlrunner"
+)
+
+// NewRunner creates a nomad.Runner for MySQL migrations
+func NewRunner(db *sql.DB, list *nomad.List) *nomad.Runner {
+	ctx := NewContext(db)
+	vs := NewVersionStore(db)
+	vs.Context = ctx
+	ctx.VersionStore = vs
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
+}
+
+// Context is passed to every migration. MySQL commits implicitly before and
+// after every DDL statement, so migrations run without a transaction by
+// default and Tx is nil. Migrations that only change data can ask for one
+// with TxPerMigration.
+type Context struct {
+	DB        *sql.DB
+	Tx        *sql.Tx
+	TxMode    nomad.TxMode     // Default transaction mode, TxNone if unset
+	Migration *nomad.Migration // Migration that's currently running
+
+	// VersionStore marks the running migration as dirty, so a migration that
+	// fails partway blocks the next runs. Set by NewRunner.
+	VersionStore *VersionStore
+
+	direction nomad.Direction
+}
+
+func NewContext(db *sql.DB) *Context {
+	return &Context{DB: db}
+}
+
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+	c.direction = d
+}
+
+// Exec runs the query in the current transaction, or directly on the database
+// when the migration runs without one
+func (c *Context) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if c.Tx != nil {
+		return c.Tx.Exec(query, args...)
+	}
+	return c.DB.Exec(query, args...)
+}
+
+// TxModes implements nomad.Transactional. It only returns TxPerMigration or
+// TxNone, since a transaction can't span more than one migration when their
+// DDL would commit it anyway.
+func (c *Context) TxModes() (run, migration nomad.TxMode) {
+	run, migration = c.TxMode, c.TxMode
+	if c.Migration != nil && c.Migration.TxMode != nomad.TxDefault {
+		migration = c.Migration.TxMode
+	}
+	return perMigration(run), perMigration(migration)
+}
+
+func perMigration(mode nomad.TxMode) nomad.TxMode {
+	if mode == nomad.TxPerMigration || mode == nomad.TxPerRun {
+		return nomad.TxPerMigration
+	}
+	return nomad.TxNone
+}
+
+// InTx implements nomad.Transactional
+func (c *Context) InTx() bool {
+	return c.Tx != nil
+}
+
+// SQLTx implements sqlrunner.TxContext
+func (c *Context) SQLTx() *sql.Tx {
+	return c.Tx
+}
+
+// Begin starts a transaction, used by the hooks
+func (c *Context) Begin() error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	c.Tx = tx
+	return nil
+}
+
+// Commit commits the transaction, used by the hooks
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Commit()
+}
+
+// Rollback rolls back the transaction, used by the hooks
+func (c *Context) Rollback() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Rollback()
+}
+
+func (c *Context) version() string {
+	if c.Migration == nil {
+		return ""
+	}
+	return c.Migration.Version
+}
+
+// DirtyError is returned when a migration failed partway, which leaves the
+// schema in an unknown state. Fix the schema by hand and call
+// VersionStore.Resolve to continue.
+type DirtyError struct {
+	Version   string
+	Direction nomad.Direction
+}
+
+func (e *DirtyError) Error() string {
+	return fmt.Sprintf("Migration %q failed partway while migrating %s, resolve it before running migrations", e.Version, e.Direction)
+}
+
+// NewHooks creates the hooks that protect against migrations that failed
+// partway. Before a migration runs, its version is marked as dirty, and the
+// mark is only cleared when it succeeded. As long as a version is dirty, runs
+// and rollbacks refuse to start with a *DirtyError.
+//
+// Migrations run without a transaction, unless they use TxPerMigration. Then
+// a failure rolls back the transaction and clears the mark, which is only
+// safe for migrations that don't contain DDL.
+func NewHooks() *nomad.Hooks {
+	tx := &nomad.TxHooks{}
+	hooks := tx.Hooks()
+	hooks.BeforeRun = func(ctx interface{}) error {
+		c := ctx.(*Context)
+		if c.VersionStore == nil {
+			return nil
+		}
+		return c.VersionStore.checkDirty()
+	}
+	hooks.Before = func(ctx interface{}) error {
+		c := ctx.(*Context)
+		if c.VersionStore != nil {
+			// Outside of the transaction, so the mark survives a failure
+			if err := c.VersionStore.markDirty(c.version(), c.direction); err != nil {
+				return err
+			}
+		}
+		return tx.Before(c)
+	}
+	// A failed migration stays dirty, unless it ran in a transaction that
+	// rolled back all of its changes
+	hooks.OnError = func(ctx interface{}, origErr error) error {
+		c := ctx.(*Context)
+		if !c.InTx() {
+			return origErr
+		}
+		if err := tx.OnError(c, origErr); err != origErr {
+			return err
+		}
+		if c.VersionStore != nil {
+			if err := c.VersionStore.clearDirty(c.version(), c.direction); err != nil {
+				return err
+			}
+		}
+		return origErr
+	}
+	return hooks
+}
+
+// Statements of the VersionStore, besides the ones of sqlrunner. %s is
+// replaced by the quoted table name.
+const (
+	createVersionTable = `CREATE TABLE IF NOT EXISTS %s (
+  version VARCHAR(255) NOT NULL PRIMARY KEY,
+  dirty BOOLEAN NOT NULL DEFAULT FALSE,
+  direction VARCHAR(4) NOT NULL DEFAULT 'up'
+)`
+	selectVersion = "SELECT dirty FROM %s WHERE version = ?"
+	selectDirty   = "SELECT version, direction FROM %s WHERE dirty LIMIT 1"
+	insertVersion = "INSERT INTO %s (version) VALUES (?) ON DUPLICATE KEY UPDATE dirty = FALSE"
+	deleteVersion = "DELETE FROM %s WHERE version = ?"
+	markDirty     = "INSERT INTO %s (version, dirty, direction) VALUES (?, TRUE, ?) ON DUPLICATE KEY UPDATE dirty = TRUE, direction = VALUES(direction)"
+)
+
+// DefaultTable stores the versions, unless VersionStore.Table is set
+const DefaultTable = sqlrunner.DefaultTable
+
+// VersionStore is the one of sqlrunner, with a dirty flag per version
+type VersionStore struct {
+	DB *sql.DB
+	// Table stores the versions, DefaultTable if empty
+	Table string
+	// Context, when set, makes version changes part of the transaction the
+	// migration runs in
+	Context *Context
+	// LockWait is how long Lock waits for another run to finish, in whole
+	// seconds. Zero gives up right away.
+	LockWait time.Duration
+
+	store *sqlrunner.VersionStore
+}
+
+func NewVersionStore(db *sql.DB) *VersionStore {
+	return &VersionStore{DB: db}
+}
+
+// sqlStore returns the store of sqlrunner, with the settings of vs
+func (vs *VersionStore) sqlStore() *sqlrunner.VersionStore {
+	if vs.store == nil {
+		vs.store = &sqlrunner.VersionStore{}
+	}
+	vs.store.DB, vs.store.Table, vs.store.Context = vs.DB, vs.Table, nil
+	vs.store.Dialect = sqlrunner.MySQLDialect{LockWait: vs.LockWait}
+	if vs.Context != nil {
+		vs.store.Context = vs.Context
+	}
+	return vs.store
+}
+
+func (vs *VersionStore) query(statement string) string {
+	return fmt.Sprintf(statement, vs.sqlStore().QuotedTable())
+}
+
+// HasVersion reports whether the version was applied. Dirty versions don't
+// count.
+func (vs *VersionStore) HasVersion(v string) bool {
+	var dirty bool
+	err := vs.sqlStore().Conn().QueryRow(vs.query(selectVersion), v).Scan(&dirty)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case err != nil:
+		panic(err)
+	default:
+		return !dirty
+	}
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	_, err := vs.sqlStore().Conn().Exec(vs.query(insertVersion), v)
+	return err
+}
+
+func (vs *VersionStore) RemoveVersion(v string) error {
+	return vs.sqlStore().RemoveVersion(v)
+}
+
+// SetupVersionStore creates the table to store the versions
+func (vs *VersionStore) SetupVersionStore() error {
+	_, err := vs.DB.Exec(vs.query(createVersionTable))
+	return err
+}
+
+// Versions returns the applied versions, in order. Unlike the other methods it
+// doesn't need the table to exist.
+func (vs *VersionStore) Versions() ([]string, error) {
+	versions, err := vs.sqlStore().Versions()
+	if err != nil || len(versions) == 0 {
+		return versions, err
+	}
+	dirty, err := vs.Dirty()
+	if err != nil || dirty == nil {
+		return versions, err
+	}
+	applied := versions[:0]
+	for _, v := range versions {
+		if v != dirty.Version {
+			applied = append(applied, v)
+		}
+	}
+	return applied, nil
+}
+
+// Lock implements nomad.Locker with GET_LOCK, so two runs against the same
+// table can't migrate at the same time. It holds on to a connection of DB
+// until Unlock, which MySQL also releases the lock with when the process dies.
+func (vs *VersionStore) Lock() error {
+	return vs.sqlStore().Lock()
+}
+
+// Unlock releases the lock acquired by Lock
+func (vs *VersionStore) Unlock() error {
+	return vs.sqlStore().Unlock()
+}
+
+// Dirty returns the migration that failed partway, if there is one
+func (vs *VersionStore) Dirty() (*DirtyError, error) {
+	var v, direction string
+	err := vs.DB.QueryRow(vs.query(selectDirty)).Scan(&v, &direction)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	d := nomad.DirectionUp
+	if direction == nomad.DirectionDown.String() {
+		d = nomad.DirectionDown
+	}
+	return &DirtyError{Version: v, Direction: d}, nil
+}
+
+func (vs *VersionStore) checkDirty() error {
+	dirty, err := vs.Dirty()
+	if err != nil {
+		return err
+	}
+	if dirty != nil {
+		return dirty
+	}
+	return nil
+}
+
+// Resolve clears the dirty mark of a version after its schema changes were
+// fixed by hand. applied tells whether the migration now counts as applied.
+func (vs *VersionStore) Resolve(v string, applied bool) error {
+	query := vs.query(deleteVersion)
+	if applied {
+		query = vs.query(insertVersion)
+	}
+	_, err := vs.DB.Exec(query, v)
+	return err
+}
+
+func (vs *VersionStore) markDirty(v string, d nomad.Direction) error {
+	_, err := vs.DB.Exec(vs.query(markDirty), v, d.String())
+	return err
+}
+
+// clearDirty restores the state from before the migration was marked dirty
+func (vs *VersionStore) clearDirty(v string, d nomad.Direction) error {
+	return vs.Resolve(v, d == nomad.DirectionDown)
+}
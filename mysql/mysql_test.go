@@ -0,0 +1,181 @@
+package mysql
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/mcls/nomad"
+)
+
+// setupDatabase connects to MYSQL_DSN, e.g. "root@/nomad_db_test", and skips
+// the test when it isn't set
+func setupDatabase(t *testing.T) *sql.DB {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_DSN isn't set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"schema_migrations", "users"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func exec(query string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		_, err := ctx.(*Context).Exec(query)
+		return err
+	}
+}
+
+func TestImplementsInterfaces(t *testing.T) {
+	var _ nomad.VersionStore = NewVersionStore(nil)
+	var _ nomad.Locker = NewVersionStore(nil)
+	var _ nomad.VersionLister = NewVersionStore(nil)
+}
+
+func TestRunAndRollback(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up:      exec("CREATE TABLE users (id INT PRIMARY KEY)"),
+		Down:    exec("DROP TABLE users"),
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Expected A to be applied")
+	}
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Expected A to be rolled back")
+	}
+}
+
+func TestDirtyMigration(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			// The CREATE TABLE is committed right away
+			if _, err := c.Exec("CREATE TABLE users (id INT PRIMARY KEY)"); err != nil {
+				return err
+			}
+			_, err := c.Exec("ALTER TABLE users ADD COLUMN")
+			return err
+		},
+	})
+	l.Add(&nomad.Migration{Version: "B", Up: exec("SELECT 1")})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected A to fail")
+	}
+
+	err := runner.Run()
+	var dirtyErr *DirtyError
+	if !errors.As(err, &dirtyErr) || dirtyErr.Version != "A" {
+		t.Fatalf("Expected the next run to refuse to start, got %v", err)
+	}
+	if runner.HasVersion("A") || runner.HasVersion("B") {
+		t.Fatal("Expected no versions to be applied")
+	}
+
+	// Someone finished the migration by hand
+	vs := runner.VersionStore.(*VersionStore)
+	if err := vs.Resolve("A", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !runner.HasVersion("B") {
+		t.Fatal("Expected A and B to be applied")
+	}
+}
+
+func TestTxPerMigration_ClearsDirtyMark(t *testing.T) {
+	db := setupDatabase(t)
+	if _, err := db.Exec("CREATE TABLE users (id INT PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		TxMode:  nomad.TxPerMigration,
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if _, err := c.Tx.Exec("INSERT INTO users VALUES (1)"); err != nil {
+				return err
+			}
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil || err.Error() != "Oh no" {
+		t.Fatalf("Expected A to fail, got %v", err)
+	}
+	dirty, err := runner.VersionStore.(*VersionStore).Dirty()
+	if err != nil || dirty != nil {
+		t.Fatalf("Expected no dirty migration, got %v (%v)", dirty, err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM users").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("Expected the insert to be rolled back, got %d rows (%v)", n, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	db := setupDatabase(t)
+	first, second := NewVersionStore(db), NewVersionStore(db)
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nomad.ErrLockNotAcquired {
+		t.Fatalf("Expected the lock to be held, got %v", err)
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
+
+func TestTxModes(t *testing.T) {
+	c := NewContext(nil)
+	tests := []struct {
+		run, migration, want nomad.TxMode
+	}{
+		{nomad.TxDefault, nomad.TxDefault, nomad.TxNone},
+		{nomad.TxPerRun, nomad.TxDefault, nomad.TxPerMigration},
+		{nomad.TxNone, nomad.TxPerMigration, nomad.TxPerMigration},
+		{nomad.TxPerMigration, nomad.TxNone, nomad.TxNone},
+	}
+	for _, test := range tests {
+		c.TxMode = test.run
+		c.SetMigration(&nomad.Migration{TxMode: test.migration}, nomad.DirectionUp)
+		if _, mode := c.TxModes(); mode != test.want {
+			t.Errorf("Expected %d for %d/%d, got %d", test.want, test.run, test.migration, mode)
+		}
+	}
+}
@@ -1,15 +1,75 @@
 package nomad
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sort"
+	"strings"
+	"time"
+)
+
+// TxMode determines how migrations are wrapped in transactions. It's up to the
+// context and hooks of a runner to honour it, e.g. TxHooks do.
+type TxMode int
+
+const (
+	TxDefault      TxMode = iota // Use the runner's default mode
+	TxPerMigration               // Run each migration in its own transaction
+	TxPerRun                     // Run all pending migrations in one transaction
+	TxNone                       // Don't use a transaction
 )
 
 type Migration struct {
 	Version string                      // Unique version
 	Up      func(ctx interface{}) error // Ran when migrating
 	Down    func(ctx interface{}) error // Ran when rolling back
+	TxMode  TxMode                      // Overrides the runner's transaction mode
+	Phase   string                      // Deploy phase, PhasePre if empty
+
+	// Versions that have to be applied before this migration can run
+	DependsOn []string
+
+	// Limits for runners that support them, e.g. pg. Zero uses the runner's
+	// defaults.
+	LockTimeout      time.Duration // Max time a statement waits for a lock
+	StatementTimeout time.Duration // Max time a single statement may take
+}
+
+// Phases of a zero-downtime deploy. Pre-deploy migrations expand the schema
+// before the new code rolls out, post-deploy migrations contract it once the
+// old code is gone.
+const (
+	PhasePre  = "pre"
+	PhasePost = "post"
+)
+
+func (m *Migration) phase() string {
+	if m.Phase == "" {
+		return PhasePre
+	}
+	return m.Phase
+}
+
+// Direction in which a migration is applied
+type Direction int
+
+const (
+	DirectionUp Direction = iota
+	DirectionDown
+)
+
+func (d Direction) String() string {
+	if d == DirectionDown {
+		return "down"
+	}
+	return "up"
+}
+
+// MigrationSetter can be implemented by a context that needs to know which
+// migration is about to run, e.g. to decide whether to open a transaction.
+type MigrationSetter interface {
+	SetMigration(m *Migration, d Direction)
 }
 
 // VersionStore checks whether versions are up to date
@@ -20,19 +80,60 @@ type VersionStore interface {
 	SetupVersionStore() error
 }
 
+// Locker can be implemented by a VersionStore to keep two runs from migrating
+// at the same time. Lock returns ErrLockNotAcquired when another run holds
+// the lock.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// ErrLockNotAcquired is returned when another run holds the lock
+var ErrLockNotAcquired = errors.New("Lock not acquired, migrations are running elsewhere")
+
+// VersionLister can be implemented by a VersionStore to list the applied
+// versions, so Status can report applied migrations that aren't in the list
+type VersionLister interface {
+	Versions() ([]string, error)
+}
+
+// MigrationError is returned when a migration failed. Its message is the one
+// of the error that caused it.
+type MigrationError struct {
+	Version   string
+	Direction Direction
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
 type Hooks struct {
-	Before  func(interface{}) error        // Before is called before running or rolling back a migration
-	After   func(interface{}) error        // After is called after running or rolling back a migration
-	OnError func(interface{}, error) error // OnError is called if anything goes wrong during a migration
+	Before    func(interface{}) error        // Before is called before running or rolling back a migration
+	After     func(interface{}) error        // After is called after running or rolling back a migration
+	OnError   func(interface{}, error) error // OnError is called if anything goes wrong during a migration
+	BeforeRun func(interface{}) error        // BeforeRun is called once at the start of Run or Rollback
+	AfterRun  func(interface{}) error        // AfterRun is called once after Run or Rollback succeeded
+	// OnRetry is called before a failed migration is attempted again. attempt
+	// is the number of the upcoming attempt. Returning an error aborts.
+	OnRetry func(ctx interface{}, attempt int, err error) error
 }
 
 // List is a list of migrations
 type List struct {
 	migrations []*Migration
+	// Compare returns -1, 0 or 1 when version a comes before, is the same as
+	// or comes after b. Versions are compared as strings if it's nil.
+	Compare func(a, b string) int
 }
 
 func NewList() *List {
-	return &List{[]*Migration{}}
+	return &List{migrations: []*Migration{}}
 }
 
 func (m *List) Add(migration *Migration) {
@@ -48,9 +149,14 @@ func (m *List) Len() int {
 }
 
 func (m *List) Less(i, j int) bool {
-	a := m.migrations[i]
-	b := m.migrations[j]
-	return a.Version < b.Version
+	return m.compare(m.migrations[i].Version, m.migrations[j].Version) < 0
+}
+
+func (m *List) compare(a, b string) int {
+	if m.Compare != nil {
+		return m.Compare(a, b)
+	}
+	return strings.Compare(a, b)
 }
 
 func (m *List) Swap(i, j int) {
@@ -68,6 +174,7 @@ func (m *List) Sort() {
 type Runner struct {
 	VersionStore
 	Context interface{}
+	Retry   *RetryPolicy // Retries failed migrations, if set
 	list    *List
 	hooks   *Hooks
 }
@@ -85,21 +192,132 @@ func NewRunner(versionStore VersionStore, list *List, context interface{}, hooks
 	return runner
 }
 
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Version string `json:"version"`
+	Phase   string `json:"phase,omitempty"`
+	Applied bool   `json:"applied"`
+	// Unknown is set for applied versions that aren't in the list, e.g. when
+	// a migration was deleted or comes from another branch
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// Run runs all pending migrations
 func (r *Runner) Run() error {
+	return r.run("")
+}
+
+// RunPhase runs the pending migrations of a single phase, e.g. PhasePost.
+// Migrations of other phases than PhasePre only run once no pre-deploy
+// migrations are pending. Phases other than PhasePre and PhasePost have to be
+// used by a migration of the list, so a misspelled phase isn't mistaken for
+// one without pending migrations.
+func (r *Runner) RunPhase(phase string) error {
+	return r.run(phase)
+}
+
+func (r *Runner) run(phase string) error {
 	if err := r.setup(); err != nil {
 		return err
 	}
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pending, err := r.pending(phase)
+	if err != nil {
+		return err
+	}
+	if err := r.beforeRun(); err != nil {
+		return err
+	}
+	for _, x := range pending {
+		log.Printf("Running migration %q\n", x.Version)
+		if err := r.runWithHooks(x, DirectionUp, r.migrateUp); err != nil {
+			return err
+		}
+
+	}
+	return r.afterRun()
+}
+
+// pending returns the migrations of the phase that have to run, after checking
+// that they can run
+func (r *Runner) pending(phase string) ([]*Migration, error) {
+	if !r.knowsPhase(phase) {
+		return nil, fmt.Errorf("Unknown phase %q", phase)
+	}
+	pending := []*Migration{}
+	scheduled := map[string]bool{}
 	for _, x := range r.list.migrations {
 		if r.HasVersion(x.Version) {
 			continue
 		}
-		log.Printf("Running migration %q\n", x.Version)
-		if err := r.runWithHooks(x, r.migrateUp); err != nil {
-			return err
+		if phase != "" && phase != PhasePre && x.phase() == PhasePre {
+			return nil, fmt.Errorf("Pre-deploy migration %q is still pending", x.Version)
 		}
+		if phase != "" && x.phase() != phase {
+			continue
+		}
+		for _, dep := range x.DependsOn {
+			if !scheduled[dep] && !r.HasVersion(dep) {
+				return nil, fmt.Errorf("Migration %q depends on %q, which hasn't been applied", x.Version, dep)
+			}
+		}
+		scheduled[x.Version] = true
+		pending = append(pending, x)
+	}
+	return pending, nil
+}
 
+func (r *Runner) knowsPhase(phase string) bool {
+	if phase == "" || phase == PhasePre || phase == PhasePost {
+		return true
 	}
-	return nil
+	for _, x := range r.list.migrations {
+		if x.phase() == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Status reports for every migration, in order, whether it has been applied
+func (r *Runner) Status() ([]MigrationStatus, error) {
+	if err := r.setup(); err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, r.list.Len())
+	for _, x := range r.list.migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version: x.Version,
+			Phase:   x.phase(),
+			Applied: r.HasVersion(x.Version),
+		})
+	}
+
+	lister, ok := r.VersionStore.(VersionLister)
+	if !ok {
+		return statuses, nil
+	}
+	versions, err := lister.Versions()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, x := range r.list.migrations {
+		known[x.Version] = true
+	}
+	for _, v := range versions {
+		if !known[v] {
+			statuses = append(statuses, MigrationStatus{Version: v, Applied: true, Unknown: true})
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return r.list.compare(statuses[i].Version, statuses[j].Version) < 0
+	})
+	return statuses, nil
 }
 
 // setup setup the version store and sorts the migrations according to their
@@ -113,11 +331,36 @@ func (r *Runner) setup() error {
 	}
 }
 
+// lock acquires the lock of the version store, if it has one, and returns
+// the function that releases it
+func (r *Runner) lock() (func(), error) {
+	locker, ok := r.VersionStore.(Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := locker.Lock(); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := locker.Unlock(); err != nil {
+			log.Printf("Couldn't release the lock: %s\n", err)
+		}
+	}, nil
+}
+
 // Rollback reverts the last migration
 func (r *Runner) Rollback() error {
 	if err := r.setup(); err != nil {
 		return err
 	}
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.beforeRun(); err != nil {
+		return err
+	}
 	sort.Sort(sort.Reverse(r.list))
 	for _, x := range r.list.migrations {
 		if !r.HasVersion(x.Version) {
@@ -125,16 +368,61 @@ func (r *Runner) Rollback() error {
 		}
 		log.Printf("Rolling back migration %q\n", x.Version)
 		// Stop after one rollback
-		return r.runWithHooks(x, r.migrateDown)
+		if err := r.runWithHooks(x, DirectionDown, r.migrateDown); err != nil {
+			return err
+		}
+		break
+	}
+	return r.afterRun()
+}
+
+func (r *Runner) beforeRun() error {
+	if r.hooks.BeforeRun != nil {
+		return r.hooks.BeforeRun(r.Context)
 	}
 	return nil
 }
 
-func (r *Runner) runWithHooks(migration *Migration, fn func(*Migration) error) error {
+func (r *Runner) afterRun() error {
+	if r.hooks.AfterRun != nil {
+		return r.hooks.AfterRun(r.Context)
+	}
+	return nil
+}
+
+// runWithHooks runs a migration and wraps its error in a *MigrationError
+func (r *Runner) runWithHooks(migration *Migration, d Direction, fn func(*Migration) error) error {
+	if err := r.runWithRetries(migration, d, fn); err != nil {
+		return &MigrationError{Version: migration.Version, Direction: d, Err: err}
+	}
+	return nil
+}
+
+func (r *Runner) runWithRetries(migration *Migration, d Direction, fn func(*Migration) error) error {
 	if fn == nil {
 		return fmt.Errorf("No function for migration")
 	}
 
+	if setter, ok := r.Context.(MigrationSetter); ok {
+		setter.SetMigration(migration, d)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := r.runOnce(migration, fn)
+		if err == nil || !r.Retry.shouldRetry(attempt, err) {
+			return err
+		}
+		log.Printf("Retrying migration %q after error: %s\n", migration.Version, err)
+		if r.hooks.OnRetry != nil {
+			if err2 := r.hooks.OnRetry(r.Context, attempt+1, err); err2 != nil {
+				return err2
+			}
+		}
+		r.Retry.wait(attempt + 1)
+	}
+}
+
+func (r *Runner) runOnce(migration *Migration, fn func(*Migration) error) error {
 	if r.hooks.Before != nil {
 		if err := r.hooks.Before(r.Context); err != nil {
 			return err
@@ -0,0 +1,190 @@
+// Helps with testing code that runs migrations
+package nomadtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+// Op names a method of a VersionStore
+type Op string
+
+const (
+	OpSetup    Op = "SetupVersionStore"
+	OpHas      Op = "HasVersion"
+	OpAdd      Op = "AddVersion"
+	OpRemove   Op = "RemoveVersion"
+	OpLock     Op = "Lock"
+	OpUnlock   Op = "Unlock"
+	OpVersions Op = "Versions"
+)
+
+// Call is a call made to a FaultyStore
+type Call struct {
+	Op      Op
+	Version string // Empty for calls without a version
+	Err     error  // Error the call returned
+}
+
+// Fault is injected into the calls that match its Op and Version
+type Fault struct {
+	Op      Op
+	Version string // Only calls for this version, any if empty
+	// Times limits how often the fault is injected, every time if zero
+	Times int
+
+	Delay time.Duration // Wait before the call
+	Err   error         // Return instead of calling the store
+	Panic interface{}   // Panic with this value instead of calling the store
+}
+
+// FaultyStore wraps a VersionStore, injects faults into its calls and records
+// them. HasVersion can't return an error, so it panics with Err, like the
+// stores of this module do. Lock, Unlock and Versions are passed on if the
+// wrapped store supports them, and do nothing otherwise.
+type FaultyStore struct {
+	nomad.VersionStore
+
+	mu     sync.Mutex
+	faults []*Fault
+	calls  []Call
+}
+
+func NewFaultyStore(vs nomad.VersionStore) *FaultyStore {
+	return &FaultyStore{VersionStore: vs}
+}
+
+// Inject adds a fault. When several match a call, the first one added wins.
+func (s *FaultyStore) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Calls returns the calls made so far, in order
+func (s *FaultyStore) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// CallsTo returns the calls made to one method, in order
+func (s *FaultyStore) CallsTo(op Op) []Call {
+	calls := []Call{}
+	for _, c := range s.Calls() {
+		if c.Op == op {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// fault returns the fault to inject into a call, if any, and uses it up
+func (s *FaultyStore) fault(op Op, v string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.faults {
+		if f.Op != op || (f.Version != "" && f.Version != v) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *FaultyStore) record(op Op, v string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Op: op, Version: v, Err: err})
+}
+
+// call injects the fault of the call, if any, or else calls fn
+func (s *FaultyStore) call(op Op, v string, fn func() error) error {
+	f := s.fault(op, v)
+	if f != nil && f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if f != nil && f.Panic != nil {
+		s.record(op, v, nil)
+		panic(f.Panic)
+	}
+	var err error
+	if f != nil && f.Err != nil {
+		err = f.Err
+	} else {
+		err = fn()
+	}
+	s.record(op, v, err)
+	return err
+}
+
+func (s *FaultyStore) SetupVersionStore() error {
+	return s.call(OpSetup, "", s.VersionStore.SetupVersionStore)
+}
+
+func (s *FaultyStore) HasVersion(v string) bool {
+	var has bool
+	err := s.call(OpHas, v, func() error {
+		has = s.VersionStore.HasVersion(v)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return has
+}
+
+func (s *FaultyStore) AddVersion(v string) error {
+	return s.call(OpAdd, v, func() error {
+		return s.VersionStore.AddVersion(v)
+	})
+}
+
+func (s *FaultyStore) RemoveVersion(v string) error {
+	return s.call(OpRemove, v, func() error {
+		return s.VersionStore.RemoveVersion(v)
+	})
+}
+
+// Lock implements nomad.Locker
+func (s *FaultyStore) Lock() error {
+	return s.call(OpLock, "", func() error {
+		if locker, ok := s.VersionStore.(nomad.Locker); ok {
+			return locker.Lock()
+		}
+		return nil
+	})
+}
+
+// Unlock implements nomad.Locker
+func (s *FaultyStore) Unlock() error {
+	return s.call(OpUnlock, "", func() error {
+		if locker, ok := s.VersionStore.(nomad.Locker); ok {
+			return locker.Unlock()
+		}
+		return nil
+	})
+}
+
+// Versions implements nomad.VersionLister
+func (s *FaultyStore) Versions() ([]string, error) {
+	var versions []string
+	err := s.call(OpVersions, "", func() error {
+		lister, ok := s.VersionStore.(nomad.VersionLister)
+		if !ok {
+			return nil
+		}
+		var err error
+		versions, err = lister.Versions()
+		return err
+	})
+	return versions, err
+}
@@ -0,0 +1,113 @@
+package nomadtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/inmem"
+)
+
+func noop(ctx interface{}) error { return nil }
+
+func list(versions ...string) *nomad.List {
+	l := nomad.NewList()
+	for _, v := range versions {
+		l.Add(&nomad.Migration{Version: v, Up: noop, Down: noop})
+	}
+	return l
+}
+
+func TestImplementsInterfaces(t *testing.T) {
+	var _ nomad.VersionStore = NewFaultyStore(nil)
+	var _ nomad.Locker = NewFaultyStore(nil)
+	var _ nomad.VersionLister = NewFaultyStore(nil)
+}
+
+func TestFaultyStore_AddVersionFails(t *testing.T) {
+	cause := errors.New("Disk full")
+	vs := NewFaultyStore(inmem.NewMemVersionStore())
+	vs.Inject(Fault{Op: OpAdd, Version: "B", Err: cause})
+
+	ran := []string{}
+	l := nomad.NewList()
+	for _, v := range []string{"A", "B", "C"} {
+		v := v
+		l.Add(&nomad.Migration{Version: v, Up: func(ctx interface{}) error {
+			ran = append(ran, v)
+			return nil
+		}})
+	}
+
+	runner := nomad.NewRunner(vs, l, nil)
+	err := runner.Run()
+	var migrationErr *nomad.MigrationError
+	if !errors.As(err, &migrationErr) || migrationErr.Version != "B" || !errors.Is(err, cause) {
+		t.Fatalf("Expected B to fail with the injected error, got %v", err)
+	}
+	if len(ran) != 2 || runner.HasVersion("B") || !runner.HasVersion("A") {
+		t.Fatalf("Expected B's Up to run without its version being stored, ran %v", ran)
+	}
+
+	adds := vs.CallsTo(OpAdd)
+	if len(adds) != 2 || adds[1].Version != "B" || adds[1].Err != cause {
+		t.Fatalf("Wrong AddVersion calls: %v", adds)
+	}
+}
+
+func TestFaultyStore_SetupFails(t *testing.T) {
+	vs := NewFaultyStore(inmem.NewMemVersionStore())
+	vs.Inject(Fault{Op: OpSetup, Err: errors.New("Oh no"), Times: 1})
+
+	runner := nomad.NewRunner(vs, list("A"), nil)
+	if err := runner.Run(); err == nil || err.Error() != "Oh no" {
+		t.Fatalf("Expected the setup error, got %v", err)
+	}
+	if calls := vs.Calls(); len(calls) != 1 {
+		t.Fatalf("Nothing should run after setup failed, got %v", calls)
+	}
+
+	// The fault was used up
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultyStore_LockAndLatency(t *testing.T) {
+	vs := NewFaultyStore(inmem.NewMemVersionStore())
+	vs.Inject(Fault{Op: OpLock, Err: nomad.ErrLockNotAcquired, Times: 1})
+	vs.Inject(Fault{Op: OpAdd, Delay: 20 * time.Millisecond})
+
+	runner := nomad.NewRunner(vs, list("A", "B"), nil)
+	if err := runner.Run(); err != nomad.ErrLockNotAcquired {
+		t.Fatalf("Expected ErrLockNotAcquired, got %v", err)
+	}
+
+	start := time.Now()
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("Expected both AddVersion calls to be slow, took %s", elapsed)
+	}
+	if unlocks := vs.CallsTo(OpUnlock); len(unlocks) != 1 {
+		t.Fatalf("Expected one Unlock, got %v", unlocks)
+	}
+}
+
+func TestFaultyStore_Panics(t *testing.T) {
+	vs := NewFaultyStore(inmem.NewMemVersionStore("A"))
+	vs.Inject(Fault{Op: OpHas, Version: "A", Panic: "Connection lost"})
+
+	defer func() {
+		if r := recover(); r != "Connection lost" {
+			t.Fatalf("Expected the injected panic, got %v", r)
+		}
+		calls := vs.CallsTo(OpHas)
+		if len(calls) != 1 || calls[0].Version != "A" {
+			t.Fatalf("Expected the panicking call to be recorded, got %v", calls)
+		}
+	}()
+	nomad.NewRunner(vs, list("A"), nil).Run()
+}
@@ -0,0 +1,129 @@
+package nomadtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mcls/nomad"
+)
+
+// RunnerFactory creates a runner for a list of migrations. All runners it
+// creates have to migrate the same database.
+type RunnerFactory func(list *nomad.List) (*nomad.Runner, error)
+
+// SnapshotFunc describes the state of the database, e.g. its schema, with one
+// line per object. pg.Schema is one for PostgreSQL.
+type SnapshotFunc func() ([]string, error)
+
+// ReversibilityError is returned when a migration isn't reversible
+type ReversibilityError struct {
+	Version string
+	// After is "rollback" when rolling back didn't restore the state from
+	// before the migration, or "reapply" when applying it again led to
+	// another state than the first time
+	After string
+	Diff  []string // Lines of the expected state with "-", of the actual one with "+"
+}
+
+func (e *ReversibilityError) Error() string {
+	what := "rolling it back didn't restore the previous state"
+	if e.After == "reapply" {
+		what = "applying it again after a rollback led to another state"
+	}
+	return fmt.Sprintf("Migration %q isn't reversible, %s:\n%s", e.Version, what, strings.Join(e.Diff, "\n"))
+}
+
+// VerifyReversible applies the migrations of list one at a time. Each one is
+// applied, rolled back and applied again, and the state taken with snapshot
+// has to match before and after the rollback, and after applying it again.
+// It stops at the first migration that fails, or isn't reversible, and
+// returns a *ReversibilityError for the latter. Run it against an empty
+// database.
+func VerifyReversible(list *nomad.List, factory RunnerFactory, snapshot SnapshotFunc) error {
+	list.Sort()
+	partial := nomad.NewList()
+	for i := 0; i < list.Len(); i++ {
+		m := list.Get(i)
+		partial.Add(m)
+		runner, err := factory(partial)
+		if err != nil {
+			return err
+		}
+		if err := verify(runner, m.Version, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify applies, rolls back and reapplies the only pending migration of the
+// runner
+func verify(runner *nomad.Runner, version string, snapshot SnapshotFunc) error {
+	// The version store isn't part of what the migration changes
+	if err := runner.SetupVersionStore(); err != nil {
+		return err
+	}
+	before, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if err := runner.Run(); err != nil {
+		return err
+	}
+	applied, err := snapshot()
+	if err != nil {
+		return err
+	}
+
+	if err := runner.Rollback(); err != nil {
+		return err
+	}
+	rolledBack, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if diff := Diff(before, rolledBack); len(diff) > 0 {
+		return &ReversibilityError{Version: version, After: "rollback", Diff: diff}
+	}
+
+	if err := runner.Run(); err != nil {
+		return err
+	}
+	reapplied, err := snapshot()
+	if err != nil {
+		return err
+	}
+	if diff := Diff(applied, reapplied); len(diff) > 0 {
+		return &ReversibilityError{Version: version, After: "reapply", Diff: diff}
+	}
+	return nil
+}
+
+// Diff compares two snapshots. It returns the lines only in want prefixed
+// with "- ", and the ones only in got prefixed with "+ ", in order.
+func Diff(want, got []string) []string {
+	counts := map[string]int{}
+	for _, line := range want {
+		counts[line]++
+	}
+	for _, line := range got {
+		counts[line]--
+	}
+	diff := []string{}
+	for line, n := range counts {
+		for ; n > 0; n-- {
+			diff = append(diff, "- "+line)
+		}
+		for ; n < 0; n++ {
+			diff = append(diff, "+ "+line)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		if diff[i][2:] != diff[j][2:] {
+			return diff[i][2:] < diff[j][2:]
+		}
+		return diff[i] < diff[j]
+	})
+	return diff
+}
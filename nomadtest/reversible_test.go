@@ -0,0 +1,120 @@
+package nomadtest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/inmem"
+)
+
+// schema is a fake database, its snapshot lists the tables
+type schema map[string]bool
+
+func (s schema) snapshot() ([]string, error) {
+	lines := []string{}
+	for table := range s {
+		lines = append(lines, "table "+table)
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+func createTable(name string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		ctx.(schema)[name] = true
+		return nil
+	}
+}
+
+func dropTable(name string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		delete(ctx.(schema), name)
+		return nil
+	}
+}
+
+func verifyReversible(l *nomad.List) error {
+	db := schema{}
+	vs := inmem.NewMemVersionStore()
+	return VerifyReversible(l, func(l *nomad.List) (*nomad.Runner, error) {
+		return nomad.NewRunner(vs, l, db), nil
+	}, db.snapshot)
+}
+
+func TestVerifyReversible(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "B", Up: createTable("blogs"), Down: dropTable("blogs")})
+	l.Add(&nomad.Migration{Version: "A", Up: createTable("users"), Down: dropTable("users")})
+	if err := verifyReversible(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyReversible_DownDoesntUndoUp(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: createTable("users"), Down: dropTable("users")})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			createTable("blogs")(ctx)
+			return createTable("posts")(ctx)
+		},
+		Down: dropTable("posts"),
+	})
+	l.Add(&nomad.Migration{Version: "C", Up: createTable("tags"), Down: dropTable("tags")})
+
+	err := verifyReversible(l)
+	var revErr *ReversibilityError
+	if !errors.As(err, &revErr) {
+		t.Fatalf("Expected a *ReversibilityError, got %v", err)
+	}
+	if revErr.Version != "B" || revErr.After != "rollback" {
+		t.Fatalf("Expected B to fail the rollback, got %+v", revErr)
+	}
+	if strings.Join(revErr.Diff, ",") != "+ table blogs" {
+		t.Fatalf("Wrong diff: %v", revErr.Diff)
+	}
+	if !strings.Contains(err.Error(), `Migration "B" isn't reversible`) {
+		t.Fatalf("Wrong message: %s", err)
+	}
+}
+
+func TestVerifyReversible_ReapplyDiffers(t *testing.T) {
+	runs := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			runs++
+			if runs > 1 {
+				return createTable("users_v2")(ctx)
+			}
+			return createTable("users")(ctx)
+		},
+		Down: func(ctx interface{}) error {
+			dropTable("users")(ctx)
+			return dropTable("users_v2")(ctx)
+		},
+	})
+
+	var revErr *ReversibilityError
+	if err := verifyReversible(l); !errors.As(err, &revErr) || revErr.After != "reapply" {
+		t.Fatalf("Expected the reapply to differ, got %v", err)
+	}
+	if strings.Join(revErr.Diff, ",") != "- table users,+ table users_v2" {
+		t.Fatalf("Wrong diff: %v", revErr.Diff)
+	}
+}
+
+func TestVerifyReversible_MissingDown(t *testing.T) {
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: createTable("users")})
+
+	var migrationErr *nomad.MigrationError
+	if err := verifyReversible(l); !errors.As(err, &migrationErr) || migrationErr.Direction != nomad.DirectionDown {
+		t.Fatalf("Expected the rollback to fail, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package pg
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+// createProgressTable creates the progress table, whose name replaces %s
+const createProgressTable = `CREATE TABLE IF NOT EXISTS %s (
+  version text PRIMARY KEY,
+  cursor text NOT NULL,
+  done boolean NOT NULL DEFAULT false,
+  updated_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// Backfill is a data migration that processes rows in batches, e.g. to fill a
+// new column of a large table. Every batch runs in its own transaction
+// together with a checkpoint in a table named after the version table,
+// schema_migrations_progress by default, so a backfill that got interrupted
+// resumes where it left off. The version is only
+// recorded after the last batch.
+type Backfill struct {
+	Version string
+
+	// Batch processes the rows after cursor using c.Tx, or c.RecordedTx to
+	// record its statements, and returns the cursor for the next batch. The
+	// cursor of the first batch is empty. Batch returns done when there's
+	// nothing left to process.
+	Batch func(c *Context, cursor string) (next string, done bool, err error)
+
+	// Pause between two batches, to throttle the load on the database
+	Pause time.Duration
+
+	// Down is called when rolling back, without a transaction
+	Down func(ctx interface{}) error
+}
+
+// Migration creates the migration that runs the backfill. It doesn't run in a
+// transaction of the runner, since every batch has its own.
+func (b *Backfill) Migration() *nomad.Migration {
+	m := &nomad.Migration{
+		Version: b.Version,
+		TxMode:  nomad.TxNone,
+		Up:      b.up,
+	}
+	if b.Down != nil {
+		m.Down = b.down
+	}
+	return m
+}
+
+func (b *Backfill) up(ctx interface{}) error {
+	c := ctx.(*Context)
+	if _, err := c.DB.Exec(fmt.Sprintf(createProgressTable, c.progressTable())); err != nil {
+		return err
+	}
+
+	var cursor string
+	var done bool
+	err := c.DB.QueryRow(
+		"SELECT cursor, done FROM "+c.progressTable()+" WHERE version = $1",
+		b.Version,
+	).Scan(&cursor, &done)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	default:
+		log.Printf("Resuming backfill %q at cursor %q\n", b.Version, cursor)
+	}
+
+	for !done {
+		if cursor, done, err = b.runBatch(c, cursor); err != nil {
+			return err
+		}
+		if !done && b.Pause > 0 {
+			time.Sleep(b.Pause)
+		}
+	}
+	return nil
+}
+
+// runBatch runs a single batch and stores its checkpoint in one transaction
+func (b *Backfill) runBatch(c *Context, cursor string) (string, bool, error) {
+	// Statements only holds the batch, so long backfills don't pile them up
+	c.Statements = nil
+	if err := c.Begin(); err != nil {
+		return "", false, err
+	}
+	if err := c.setTimeouts(); err != nil {
+		return "", false, c.rollback(err)
+	}
+
+	next, done, err := b.Batch(c, cursor)
+	if err != nil {
+		return "", false, c.rollback(err)
+	}
+
+	_, err = c.Tx.Exec(`INSERT INTO `+c.progressTable()+` (version, cursor, done)
+VALUES ($1, $2, $3)
+ON CONFLICT (version) DO UPDATE
+SET cursor = EXCLUDED.cursor, done = EXCLUDED.done, updated_at = now()`,
+		b.Version, next, done)
+	if err != nil {
+		return "", false, c.rollback(err)
+	}
+	return next, done, c.Commit()
+}
+
+// progressTable returns the quoted name of the table with the checkpoints
+func (c *Context) progressTable() string {
+	vs := c.VersionStore
+	if vs == nil {
+		vs = &VersionStore{}
+	}
+	return vs.relatedTable("_progress")
+}
+
+func (b *Backfill) down(ctx interface{}) error {
+	c := ctx.(*Context)
+	if err := b.Down(ctx); err != nil {
+		return err
+	}
+	if _, err := c.DB.Exec(fmt.Sprintf(createProgressTable, c.progressTable())); err != nil {
+		return err
+	}
+	_, err := c.DB.Exec("DELETE FROM "+c.progressTable()+" WHERE version = $1", b.Version)
+	return err
+}
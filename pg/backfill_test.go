@@ -0,0 +1,100 @@
+package pg
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/mcls/nomad"
+)
+
+func TestBackfill_ResumesAfterFailure(t *testing.T) {
+	db := setupDatabase(t)
+	_, err := db.Exec(`
+	CREATE TABLE users (id serial PRIMARY KEY, username text, slug text);
+	INSERT INTO users (username) SELECT 'user' || i FROM generate_series(1, 10) i;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := 0
+	crash := true
+	backfill := &Backfill{
+		Version: "A",
+		Batch: func(c *Context, cursor string) (string, bool, error) {
+			batches += 1
+			if batches == 3 && crash {
+				return "", false, errors.New("Crashed")
+			}
+			last, _ := strconv.Atoi(cursor)
+			var next int
+			err := c.Tx.QueryRow(`
+				WITH batch AS (
+					UPDATE users SET slug = lower(username)
+					WHERE id IN (SELECT id FROM users WHERE id > $1 ORDER BY id LIMIT 3)
+					RETURNING id
+				)
+				SELECT coalesce(max(id), 0) FROM batch`, last).Scan(&next)
+			if err != nil {
+				return "", false, err
+			}
+			return strconv.Itoa(next), next == 0, nil
+		},
+	}
+
+	l := nomad.NewList()
+	l.Add(backfill.Migration())
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil || err.Error() != "Crashed" {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Shouldn't have version A before the backfill is complete")
+	}
+
+	var cursor string
+	err = db.QueryRow("SELECT cursor FROM schema_migrations_progress WHERE version = 'A'").Scan(&cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "6" {
+		t.Fatalf("Expected checkpoint at cursor 6, was %q", cursor)
+	}
+
+	crash = false
+	batches = 0
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Resumed at 7: 7-9, 10, and the empty batch
+	if batches != 3 {
+		t.Fatalf("Expected 3 batches after resuming, ran %d", batches)
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Should have version A")
+	}
+
+	var missing int
+	err = db.QueryRow("SELECT count(*) FROM users WHERE slug IS NULL").Scan(&missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing != 0 {
+		t.Fatalf("%d users weren't backfilled", missing)
+	}
+}
+
+func TestProgressTable(t *testing.T) {
+	c := NewContext(nil)
+	if table := c.progressTable(); table != `"schema_migrations_progress"` {
+		t.Fatalf("Wrong progress table %s", table)
+	}
+	c.VersionStore = &VersionStore{Table: "app.migrations"}
+	if table := c.progressTable(); table != `"app"."migrations_progress"` {
+		t.Fatalf("Wrong progress table %s", table)
+	}
+	if table := c.VersionStore.relatedTable("_history"); table != `"app"."migrations_history"` {
+		t.Fatalf("Wrong history table %s", table)
+	}
+}
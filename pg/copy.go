@@ -0,0 +1,133 @@
+package pg
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var copyNonText = regexp.MustCompile(`(?is)\bFROM\s+STDIN\b.*\b(CSV|BINARY)\b`)
+
+// CopyFrom loads the data of a COPY ... FROM stdin statement, in the text
+// format written by pg_dump. It runs in the current transaction, or in a
+// transaction of its own when the migration runs without one.
+func (c *Context) CopyFrom(query, data string) error {
+	if copyNonText.MatchString(query) {
+		return errors.New("COPY FROM stdin only supports the text format")
+	}
+
+	var tx *sql.Tx
+	if c.Tx != nil {
+		tx = c.Tx
+	} else {
+		var err error
+		if tx, err = c.DB.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	start := time.Now()
+	rows, err := copyRows(tx, query, data)
+	c.record(query, nil, start, driver.RowsAffected(rows), err)
+	if err != nil || c.Tx != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func copyRows(tx *sql.Tx, query, data string) (int64, error) {
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var rows int64
+	for _, row := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		if row == "" {
+			continue
+		}
+		if _, err := stmt.Exec(decodeCopyRow(row)...); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return rows, err
+	}
+	return rows, stmt.Close()
+}
+
+// decodeCopyRow splits a row of COPY's text format into its values. \N is
+// NULL, other backslash sequences are escapes.
+func decodeCopyRow(row string) []interface{} {
+	fields := strings.Split(strings.TrimSuffix(row, "\r"), "\t")
+	values := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if f == `\N` {
+			values[i] = nil
+		} else {
+			values[i] = unescapeCopy(f)
+		}
+	}
+	return values
+}
+
+func unescapeCopy(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			n := digits(s[i+1:], 2, "0123456789abcdefABCDEF")
+			if n == 0 {
+				b.WriteByte(c)
+				continue
+			}
+			v, _ := strconv.ParseUint(s[i+1:i+1+n], 16, 8)
+			b.WriteByte(byte(v))
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := digits(s[i:], 3, "01234567")
+			v, _ := strconv.ParseUint(s[i:i+n], 8, 8)
+			b.WriteByte(byte(v))
+			i += n - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// digits counts the leading characters of s that are in set, up to max
+func digits(s string, max int, set string) int {
+	n := 0
+	for n < len(s) && n < max && strings.IndexByte(set, s[n]) >= 0 {
+		n++
+	}
+	return n
+}
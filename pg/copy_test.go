@@ -0,0 +1,54 @@
+package pg
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/mcls/nomad/sqlfile"
+)
+
+func TestDecodeCopyRow(t *testing.T) {
+	values := decodeCopyRow(`1	\N	tab\there	back\\slash	new\nline	\101\x42	\.`)
+	want := []interface{}{"1", nil, "tab\there", `back\slash`, "new\nline", "AB", "."}
+	if len(values) != len(want) {
+		t.Fatalf("Expected %q, got %q", want, values)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Fatalf("Expected %q at %d, got %q", want[i], i, values[i])
+		}
+	}
+}
+
+func TestRunningSQLMigrations_WithCopy(t *testing.T) {
+	db := setupDatabase(t)
+
+	l, err := sqlfile.LoadFS(fstest.MapFS{
+		"001_users.sql": {Data: []byte(`-- nomad:up
+CREATE TABLE users (id int PRIMARY KEY, username text);
+COPY users (id, username) FROM stdin;
+1	mcls
+2	\N
+\.
+
+-- nomad:down
+DROP TABLE users;
+`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM users WHERE username IS NULL").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 user without username, got %d", count)
+	}
+}
@@ -3,24 +3,47 @@ package pg
 
 import (
 	"database/sql"
+	"fmt"
+	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/internal/postgres"
+	"github.com/mcls/nomad/sqlrunner"
 )
 
 // NewRunner creates a nomad.Runner for postgres migrations
 func NewRunner(db *sql.DB, list *nomad.List) *nomad.Runner {
-	return nomad.NewRunner(
-		NewVersionStore(db),
-		list,
-		NewContext(db),
-		NewHooks(),
-	)
+	ctx := NewContext(db)
+	vs := NewVersionStore(db)
+	vs.Context = ctx
+	ctx.VersionStore = vs
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
 }
 
+// Context is passed to every migration. Depending on the transaction mode Tx
+// is the transaction the migration runs in, or nil when it runs without one.
 type Context struct {
-	DB *sql.DB
-	Tx *sql.Tx
+	DB        *sql.DB
+	Tx        *sql.Tx
+	TxMode    nomad.TxMode     // Default transaction mode, TxPerMigration if unset
+	Migration *nomad.Migration // Migration that's currently running
+
+	// Statements the current migration, or batch of a Backfill, executed through
+	// RecordedTx, Exec or CopyFrom
+	Statements []Statement
+	// OnStatement is called after every recorded statement, if set
+	OnStatement func(Statement)
+
+	// VersionStore names the progress table of backfills after its table.
+	// Set by NewRunner.
+	VersionStore *VersionStore
+
+	// Default lock_timeout and statement_timeout of migrations that run in a
+	// transaction. Zero leaves the server's setting alone.
+	LockTimeout      time.Duration
+	StatementTimeout time.Duration
+
+	timeouts postgres.Timeouts // Applied to Tx with SET LOCAL
 }
 
 func NewContext(db *sql.DB) *Context {
@@ -30,75 +53,234 @@ func NewContext(db *sql.DB) *Context {
 	}
 }
 
-func beforeHook(ctx interface{}) error {
-	c := ctx.(*Context)
-	if tx, err := c.DB.Begin(); err == nil {
-		c.Tx = tx
-		return nil
-	} else {
-		return err
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+}
+
+// Exec runs the query in the current transaction, or directly on the database
+// when the migration runs without one.
+func (c *Context) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if c.Tx != nil {
+		return c.RecordedTx().Exec(query, args...)
+	}
+	start := time.Now()
+	result, err := c.DB.Exec(query, args...)
+	c.record(query, args, start, result, err)
+	return result, err
+}
+
+// TxModes implements nomad.Transactional
+func (c *Context) TxModes() (run, migration nomad.TxMode) {
+	run = c.TxMode
+	if run == nomad.TxDefault {
+		run = nomad.TxPerMigration
 	}
+	if c.Migration == nil || c.Migration.TxMode == nomad.TxDefault {
+		return run, run
+	}
+	return run, c.Migration.TxMode
+}
+
+// InTx implements nomad.Transactional
+func (c *Context) InTx() bool {
+	return c.Tx != nil
 }
-func afterHook(ctx interface{}) error {
-	c := ctx.(*Context)
-	if err := c.Tx.Commit(); err != nil {
-		c.Tx = nil
+
+// SQLTx implements sqlrunner.TxContext. Versions are changed in the
+// transaction without being recorded.
+func (c *Context) SQLTx() *sql.Tx {
+	return c.Tx
+}
+
+// Begin starts a transaction, used by the hooks
+func (c *Context) Begin() error {
+	tx, err := c.DB.Begin()
+	if err != nil {
 		return err
 	}
+	c.Tx = tx
 	return nil
 }
 
-func onError(ctx interface{}, origErr error) error {
-	c := ctx.(*Context)
-	if err := c.Tx.Rollback(); err != nil {
+// Commit commits the transaction, used by the hooks
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	c.timeouts = postgres.Timeouts{}
+	return tx.Commit()
+}
+
+// Rollback rolls back the transaction, used by the hooks
+func (c *Context) Rollback() error {
+	tx := c.Tx
+	c.Tx = nil
+	c.timeouts = postgres.Timeouts{}
+	return tx.Rollback()
+}
+
+// rollback rolls back the transaction of a backfill batch that failed with
+// origErr
+func (c *Context) rollback(origErr error) error {
+	origErr = c.timeoutError(origErr)
+	if err := c.Rollback(); err != nil {
 		return err
 	}
 	return origErr
 }
 
+// setTimeouts applies the timeouts of the current migration to Tx
+func (c *Context) setTimeouts() error {
+	defaults := postgres.Timeouts{Lock: c.LockTimeout, Statement: c.StatementTimeout}
+	return c.timeouts.Apply(c.Migration, defaults, func(query string) error {
+		_, err := c.Tx.Exec(query)
+		return err
+	})
+}
+
+// TimeoutError is returned when a migration was canceled because it exceeded
+// its lock_timeout or statement_timeout
+type TimeoutError = postgres.TimeoutError
+
+// timeoutError converts err into a *TimeoutError if it was caused by one of
+// the timeouts applied to Tx
+func (c *Context) timeoutError(err error) error {
+	return c.timeouts.Wrap(c.Migration, err)
+}
+
+// NewHooks creates the hooks that manage the transactions of a Context, see
+// nomad.TxHooks. By default every migration runs in its own transaction, with
+// the timeouts of the migration. Statements like CREATE INDEX CONCURRENTLY
+// need TxNone.
 func NewHooks() *nomad.Hooks {
-	return &nomad.Hooks{
-		Before:  beforeHook,
-		After:   afterHook,
-		OnError: onError,
+	tx := &nomad.TxHooks{}
+	hooks := tx.Hooks()
+	hooks.Before = func(ctx interface{}) error {
+		c := ctx.(*Context)
+		c.Statements = nil
+		if err := tx.Before(c); err != nil {
+			return err
+		}
+		if c.Tx == nil {
+			return nil
+		}
+		if err := c.setTimeouts(); err != nil {
+			return tx.OnError(c, err)
+		}
+		return nil
+	}
+	hooks.OnError = func(ctx interface{}, err error) error {
+		c := ctx.(*Context)
+		return tx.OnError(c, c.timeoutError(err))
 	}
+	return hooks
 }
 
+// IsTransient reports whether err is a postgres error that's likely to go away
+// when the migration is retried: a serialization failure, a deadlock or a
+// lock that couldn't be acquired in time.
+func IsTransient(err error) bool {
+	return postgres.IsTransient(err)
+}
+
+// NewRetryPolicy creates a policy that retries migrations that failed with a
+// transient error, with exponential backoff between the attempts
+func NewRetryPolicy(maxAttempts int) *nomad.RetryPolicy {
+	return postgres.NewRetryPolicy(maxAttempts)
+}
+
+// DefaultTable stores the versions, unless VersionStore.Table is set
+const DefaultTable = sqlrunner.DefaultTable
+
+// VersionStore stores the versions with the sqlrunner.Postgres dialect
 type VersionStore struct {
 	DB *sql.DB
+	// Table stores the versions, DefaultTable if empty. It can be qualified
+	// with a schema, e.g. "app.migrations".
+	Table string
+	// Context, when set, makes version changes part of the transaction the
+	// migration runs in
+	Context *Context
+	// History stores the statements a migration executed in a table named
+	// after Table, schema_migrations_history by default, for audits. Requires
+	// Context.
+	History bool
+
+	store *sqlrunner.VersionStore // Holds the lock between Lock and Unlock
 }
 
 func NewVersionStore(db *sql.DB) *VersionStore {
 	return &VersionStore{DB: db}
 }
 
-func (vs *VersionStore) HasVersion(v string) bool {
-	var found string
-	err := vs.DB.QueryRow("SELECT * FROM schema_migrations WHERE version = $1", v).Scan(&found)
-	switch {
-	case err == sql.ErrNoRows:
-		return false
-	case err != nil:
-		panic(err)
-	default:
-		return true
+// sqlStore returns the store of sqlrunner, with the settings of vs
+func (vs *VersionStore) sqlStore() *sqlrunner.VersionStore {
+	if vs.store == nil {
+		vs.store = sqlrunner.NewVersionStore(vs.DB, sqlrunner.Postgres)
 	}
+	vs.store.DB, vs.store.Table, vs.store.Context = vs.DB, vs.Table, nil
+	if vs.Context != nil {
+		vs.store.Context = vs.Context
+	}
+	return vs.store
+}
+
+func (vs *VersionStore) table() string {
+	if vs.Table == "" {
+		return DefaultTable
+	}
+	return vs.Table
+}
+
+// relatedTable returns the quoted name of a table that belongs to the version
+// table, e.g. schema_migrations_history
+func (vs *VersionStore) relatedTable(suffix string) string {
+	return sqlrunner.Postgres.QuoteIdentifier(vs.table() + suffix)
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	return vs.sqlStore().HasVersion(v)
 }
 
 func (vs *VersionStore) AddVersion(v string) error {
-	_, err := vs.DB.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", v)
-	return err
+	if err := vs.addHistory(v, nomad.DirectionUp); err != nil {
+		return err
+	}
+	return vs.sqlStore().AddVersion(v)
 }
 
 func (vs *VersionStore) RemoveVersion(v string) error {
-	_, err := vs.DB.Exec("DELETE FROM schema_migrations WHERE version = $1", v)
-	return err
+	if err := vs.addHistory(v, nomad.DirectionDown); err != nil {
+		return err
+	}
+	return vs.sqlStore().RemoveVersion(v)
 }
 
-// SetupVersionStore creates the schema_migrations table to store the versions
+// SetupVersionStore creates the table to store the versions
 func (vs *VersionStore) SetupVersionStore() error {
-	_, err := vs.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
-  version text NOT NULL UNIQUE
-)`)
-	return err
+	if err := vs.sqlStore().SetupVersionStore(); err != nil {
+		return err
+	}
+	if vs.History {
+		_, err := vs.DB.Exec(fmt.Sprintf(createHistoryTable, vs.relatedTable("_history")))
+		return err
+	}
+	return nil
+}
+
+// Versions returns the applied versions, in order. Unlike the other methods it
+// doesn't need the table to exist.
+func (vs *VersionStore) Versions() ([]string, error) {
+	return vs.sqlStore().Versions()
+}
+
+// Lock implements nomad.Locker with a session-level advisory lock, so two
+// runs against the same table can't migrate at the same time
+func (vs *VersionStore) Lock() error {
+	return vs.sqlStore().Lock()
+}
+
+// Unlock releases the lock acquired by Lock
+func (vs *VersionStore) Unlock() error {
+	return vs.sqlStore().Unlock()
 }
@@ -2,12 +2,16 @@ package pg
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"os/exec"
 	"testing"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/internal/postgres"
 )
 
 func setupDatabase(t *testing.T) *sql.DB {
@@ -26,6 +30,8 @@ func setupDatabase(t *testing.T) *sql.DB {
 
 	_, err = db.Exec(`
 	DROP TABLE IF EXISTS schema_migrations;
+	DROP TABLE IF EXISTS schema_migrations_progress;
+	DROP TABLE IF EXISTS schema_migrations_history;
 	DROP TABLE IF EXISTS users;
 	DROP TABLE IF EXISTS blogs;
 	`)
@@ -160,3 +166,191 @@ func TestRollingBackMigration(t *testing.T) {
 		t.Fatal("Should NOT have version B")
 	}
 }
+
+func TestRunningMigrations_TxPerRun(t *testing.T) {
+	db := setupDatabase(t)
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			_, err := c.Tx.Exec("CREATE TABLE users (id serial PRIMARY KEY, username text);")
+			return err
+		},
+	})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			_, err := c.Tx.Exec("INSERT INTO unknown_table VALUES (1)")
+			return err
+		},
+	})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	if runner.HasVersion("A") {
+		t.Fatal("Shouldn't have version A after the run failed")
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass('users') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("Table users should have been rolled back")
+	}
+}
+
+func TestRunningMigrations_TxNone(t *testing.T) {
+	db := setupDatabase(t)
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			_, err := c.Exec("CREATE TABLE users (id serial PRIMARY KEY, username text);")
+			return err
+		},
+	})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		TxMode:  nomad.TxNone,
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if c.Tx != nil {
+				return errors.New("Shouldn't run in a transaction")
+			}
+			_, err := c.Exec("CREATE INDEX CONCURRENTLY users_username_idx ON users (username)")
+			return err
+		},
+	})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"A", "B"} {
+		if !runner.HasVersion(v) {
+			t.Fatalf("Should have version %s", v)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "55P03"}, true},
+		{fmt.Errorf("wrapped: %w", &pq.Error{Code: "40P01"}), true},
+		{&pq.Error{Code: "42P01"}, false},
+		{errors.New("Oh no"), false},
+	}
+	for _, c := range cases {
+		if got := IsTransient(c.err); got != c.want {
+			t.Fatalf("IsTransient(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRunningMigrations_LockTimeout(t *testing.T) {
+	db := setupDatabase(t)
+	if _, err := db.Exec("CREATE TABLE users (id serial PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold a lock on users until the migration gave up
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE users IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version:     "A",
+		LockTimeout: 100 * time.Millisecond,
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			_, err := c.Tx.Exec("ALTER TABLE users ADD COLUMN username text")
+			return err
+		},
+	})
+
+	runner := NewRunner(db, l)
+	err = runner.Run()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected a *TimeoutError, got %#v", err)
+	}
+	if timeoutErr.Setting != "lock_timeout" || timeoutErr.Version != "A" {
+		t.Fatalf("Wrong timeout error: %s", timeoutErr)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Shouldn't have version A")
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	c := &Context{
+		Migration: &nomad.Migration{Version: "A"},
+		timeouts:  postgres.Timeouts{Statement: time.Second},
+	}
+
+	err := c.timeoutError(&pq.Error{Code: "57014"})
+	timeoutErr, ok := err.(*TimeoutError)
+	if !ok {
+		t.Fatalf("Expected a *TimeoutError, got %#v", err)
+	}
+	if timeoutErr.Setting != "statement_timeout" || timeoutErr.Timeout != time.Second {
+		t.Fatalf("Wrong timeout error: %s", timeoutErr)
+	}
+
+	// No lock_timeout was set, so this is a NOWAIT failure
+	if _, ok := c.timeoutError(&pq.Error{Code: "55P03"}).(*TimeoutError); ok {
+		t.Fatal("Shouldn't be a timeout error")
+	}
+}
+
+func TestVersionStore_Lock(t *testing.T) {
+	db := setupDatabase(t)
+	first, second := NewVersionStore(db), NewVersionStore(db)
+
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nomad.ErrLockNotAcquired {
+		t.Fatalf("Expected the lock to be held, got %v", err)
+	}
+
+	// Another table has its own lock
+	other := NewVersionStore(db)
+	other.Table = "other_migrations"
+	if err := other.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	other.Unlock()
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
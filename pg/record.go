@@ -0,0 +1,191 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+// Statement is a statement executed by a migration
+type Statement struct {
+	Query        string
+	Args         []interface{}
+	Duration     time.Duration
+	RowsAffected int64 // -1 when unknown, e.g. for queries
+	Err          error
+}
+
+// Tx is the transaction a migration runs in, returned by
+// Context.RecordedTx. It records the statements executed through it in its
+// Context, including those of prepared statements. The other methods are
+// those of sql.Tx.
+type Tx struct {
+	*sql.Tx
+	ctx *Context
+}
+
+// RecordedTx returns Tx, recording the statements executed through it, or nil
+// when the migration runs without a transaction
+func (c *Context) RecordedTx() *Tx {
+	if c.Tx == nil {
+		return nil
+	}
+	return &Tx{Tx: c.Tx, ctx: c}
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	tx.ctx.record(query, args, start, result, err)
+	return result, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	tx.ctx.record(query, args, start, nil, err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	tx.ctx.record(query, args, start, nil, row.Err())
+	return row
+}
+
+func (tx *Tx) Prepare(query string) (*Stmt, error) {
+	return tx.PrepareContext(context.Background(), query)
+}
+
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	stmt, err := tx.Tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{Stmt: stmt, query: query, ctx: tx.ctx}, nil
+}
+
+// Stmt returns a transaction-specific statement from one prepared outside of
+// it. Its executions are recorded without the query, which sql.Stmt doesn't
+// expose; prefer Prepare.
+func (tx *Tx) Stmt(stmt *sql.Stmt) *Stmt {
+	return tx.StmtContext(context.Background(), stmt)
+}
+
+func (tx *Tx) StmtContext(ctx context.Context, stmt *sql.Stmt) *Stmt {
+	return &Stmt{Stmt: tx.Tx.StmtContext(ctx, stmt), ctx: tx.ctx}
+}
+
+// Stmt is a statement prepared in a Tx, whose executions are recorded like
+// those of the Tx
+type Stmt struct {
+	*sql.Stmt
+	query string
+	ctx   *Context
+}
+
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := s.Stmt.ExecContext(ctx, args...)
+	s.ctx.record(s.query, args, start, result, err)
+	return result, err
+}
+
+func (s *Stmt) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.QueryContext(ctx, args...)
+	s.ctx.record(s.query, args, start, nil, err)
+	return rows, err
+}
+
+func (s *Stmt) QueryRow(args ...interface{}) *sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := s.Stmt.QueryRowContext(ctx, args...)
+	s.ctx.record(s.query, args, start, nil, row.Err())
+	return row
+}
+
+func (c *Context) record(query string, args []interface{}, start time.Time, result sql.Result, err error) {
+	st := Statement{
+		Query:        query,
+		Args:         args,
+		Duration:     time.Since(start),
+		RowsAffected: -1,
+		Err:          err,
+	}
+	if result != nil && err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			st.RowsAffected = n
+		}
+	}
+	c.Statements = append(c.Statements, st)
+	if c.OnStatement != nil {
+		c.OnStatement(st)
+	}
+}
+
+// createHistoryTable creates the history table, whose name replaces %s
+const createHistoryTable = `CREATE TABLE IF NOT EXISTS %s (
+  id bigserial PRIMARY KEY,
+  version text NOT NULL,
+  direction text NOT NULL,
+  position int NOT NULL,
+  statement text NOT NULL,
+  args text NOT NULL,
+  duration_ms double precision NOT NULL,
+  rows_affected bigint NOT NULL,
+  executed_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// addHistory stores the statements of the migration in the history table
+func (vs *VersionStore) addHistory(v string, d nomad.Direction) error {
+	if !vs.History || vs.Context == nil {
+		return nil
+	}
+	for i, st := range vs.Context.Statements {
+		if st.Err != nil {
+			continue
+		}
+		args, err := json.Marshal(st.Args)
+		if err != nil {
+			return err
+		}
+		_, err = vs.sqlStore().Conn().Exec(`INSERT INTO `+vs.relatedTable("_history")+`
+  (version, direction, position, statement, args, duration_ms, rows_affected)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			v, d.String(), i+1, st.Query, string(args),
+			float64(st.Duration)/float64(time.Millisecond), st.RowsAffected)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
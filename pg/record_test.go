@@ -0,0 +1,97 @@
+package pg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mcls/nomad"
+)
+
+func TestRecordingStatements(t *testing.T) {
+	db := setupDatabase(t)
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			_, err := c.Exec("CREATE TABLE users (id serial PRIMARY KEY, username text);")
+			if err != nil {
+				return err
+			}
+			_, err = c.RecordedTx().Exec("INSERT INTO users (username) VALUES ($1), ($2)", "mcls", "other")
+			return err
+		},
+	})
+
+	runner := NewRunner(db, l)
+	runner.VersionStore.(*VersionStore).History = true
+	recorded := []Statement{}
+	runner.Context.(*Context).OnStatement = func(st Statement) {
+		recorded = append(recorded, st)
+	}
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorded) != 2 {
+		t.Fatalf("Expected 2 statements, got %d", len(recorded))
+	}
+	insert := recorded[1]
+	if insert.RowsAffected != 2 || len(insert.Args) != 2 || insert.Args[0] != "mcls" {
+		t.Fatalf("Wrong statement recorded: %+v", insert)
+	}
+
+	var statement, args, direction string
+	var rows int64
+	err := db.QueryRow(`SELECT statement, args, direction, rows_affected
+		FROM schema_migrations_history WHERE version = 'A' AND position = 2`,
+	).Scan(&statement, &args, &direction, &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement != insert.Query || args != `["mcls","other"]` || direction != "up" || rows != 2 {
+		t.Fatalf("Wrong history: %q %q %q %d", statement, args, direction, rows)
+	}
+}
+
+func TestRecordingStatements_ContextAndPrepared(t *testing.T) {
+	db := setupDatabase(t)
+
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			tx := ctx.(*Context).RecordedTx()
+			_, err := tx.ExecContext(context.Background(), "CREATE TABLE users (id serial PRIMARY KEY, username text)")
+			if err != nil {
+				return err
+			}
+			stmt, err := tx.Prepare("INSERT INTO users (username) VALUES ($1)")
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			for _, username := range []string{"mcls", "other"} {
+				if _, err := stmt.Exec(username); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := runner.Context.(*Context).Statements
+	if len(recorded) != 3 {
+		t.Fatalf("Expected 3 statements, got %+v", recorded)
+	}
+	insert := recorded[2]
+	if insert.Query != "INSERT INTO users (username) VALUES ($1)" || insert.RowsAffected != 1 || insert.Args[0] != "other" {
+		t.Fatalf("Wrong statement recorded: %+v", insert)
+	}
+}
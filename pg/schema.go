@@ -0,0 +1,64 @@
+package pg
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// schemaQueries describe the objects of the current schema, one row each
+var schemaQueries = []string{
+	`SELECT 'column ' || table_name || '.' || column_name || ' ' || data_type ||
+		CASE WHEN is_nullable = 'NO' THEN ' NOT NULL' ELSE '' END ||
+		COALESCE(' DEFAULT ' || column_default, '')
+	FROM information_schema.columns
+	WHERE table_schema = current_schema()`,
+	`SELECT 'constraint ' || cl.relname || '.' || co.conname || ' ' || pg_get_constraintdef(co.oid)
+	FROM pg_constraint co
+	JOIN pg_class cl ON cl.oid = co.conrelid
+	WHERE cl.relnamespace = current_schema()::regnamespace`,
+	`SELECT 'index ' || tablename || '.' || indexname || ' ' || indexdef
+	FROM pg_indexes
+	WHERE schemaname = current_schema()`,
+	`SELECT 'view ' || table_name || ' ' || view_definition
+	FROM information_schema.views
+	WHERE table_schema = current_schema()`,
+	`SELECT 'sequence ' || sequence_name || ' ' || data_type
+	FROM information_schema.sequences
+	WHERE sequence_schema = current_schema()`,
+	`SELECT 'type ' || t.typname || ' enum (' || string_agg(e.enumlabel, ', ' ORDER BY e.enumsortorder) || ')'
+	FROM pg_type t
+	JOIN pg_enum e ON e.enumtypid = t.oid
+	WHERE t.typnamespace = current_schema()::regnamespace
+	GROUP BY t.typname`,
+}
+
+// Schema describes the tables, columns, constraints, indexes, views,
+// sequences and enums of the current schema, one sorted line per object. It
+// can be passed to nomadtest.VerifyReversible as the snapshot:
+//
+//	nomadtest.VerifyReversible(list, factory, func() ([]string, error) {
+//		return pg.Schema(db)
+//	})
+func Schema(db *sql.DB) ([]string, error) {
+	lines := []string{}
+	for _, query := range schemaQueries {
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
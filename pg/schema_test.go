@@ -0,0 +1,76 @@
+package pg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/nomadtest"
+)
+
+func TestSchema(t *testing.T) {
+	db := setupDatabase(t)
+	_, err := db.Exec(`
+	CREATE TABLE users (id serial PRIMARY KEY, username text NOT NULL);
+	CREATE INDEX users_username_idx ON users (username);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP INDEX users_username_idx")
+
+	lines, err := Schema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"column users.username text NOT NULL",
+		"constraint users.users_pkey PRIMARY KEY (id)",
+		"index users.users_username_idx CREATE INDEX",
+		"sequence users_id_seq integer",
+	} {
+		if !strings.Contains(schema, want) {
+			t.Fatalf("Expected %q in the schema:\n%s", want, schema)
+		}
+	}
+}
+
+func TestVerifyReversible(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Tx.Exec("CREATE TABLE users (id serial PRIMARY KEY)")
+			return err
+		},
+		Down: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Tx.Exec("DROP TABLE users")
+			return err
+		},
+	})
+	l.Add(&nomad.Migration{
+		Version: "B",
+		Up: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Tx.Exec("ALTER TABLE users ADD COLUMN username text")
+			return err
+		},
+		// Forgets to drop the column
+		Down: func(ctx interface{}) error { return nil },
+	})
+
+	err := nomadtest.VerifyReversible(l, func(l *nomad.List) (*nomad.Runner, error) {
+		return NewRunner(db, l), nil
+	}, func() ([]string, error) {
+		return Schema(db)
+	})
+	var revErr *nomadtest.ReversibilityError
+	if !errors.As(err, &revErr) || revErr.Version != "B" {
+		t.Fatalf("Expected B not to be reversible, got %v", err)
+	}
+	if len(revErr.Diff) != 1 || revErr.Diff[0] != "+ column users.username text" {
+		t.Fatalf("Wrong diff: %v", revErr.Diff)
+	}
+}
@@ -0,0 +1,129 @@
+package pg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/internal/postgres"
+	"github.com/mcls/nomad/sqlfile"
+	"github.com/mcls/nomad/sqlrunner"
+)
+
+// ScriptOptions select the migrations that are written to a script
+type ScriptOptions struct {
+	From      string          // First version to include, if set
+	To        string          // Last version to include, if set
+	Phase     string          // Only include migrations of this phase, if set
+	Direction nomad.Direction // DirectionDown writes a script that rolls back
+}
+
+// WriteScript writes a psql script with the SQL migrations that are pending,
+// for deployments where the migrations are applied by hand. Every migration
+// runs in a transaction, unless it has the no-transaction directive, and
+// changes the version table just like the runner would. Applying
+// the script leaves nomad's state consistent.
+//
+// When DB is nil, the script contains all migrations in the range. When
+// rolling back, it contains the applied ones in reverse order.
+func (vs *VersionStore) WriteScript(w io.Writer, scripts []*sqlfile.Script, opts ScriptOptions) error {
+	applied := map[string]bool{}
+	if vs.DB != nil {
+		versions, err := vs.Versions()
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			applied[v] = true
+		}
+	}
+
+	down := opts.Direction == nomad.DirectionDown
+	selected := []*sqlfile.Script{}
+	for _, s := range scripts {
+		switch {
+		case opts.From != "" && s.Version < opts.From:
+		case opts.To != "" && s.Version > opts.To:
+		case opts.Phase != "" && scriptPhase(s) != opts.Phase:
+		case vs.DB != nil && applied[s.Version] != down:
+		default:
+			selected = append(selected, s)
+		}
+	}
+	if down {
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("-- Generated by nomad, apply with psql\n")
+	b.WriteString("\\set ON_ERROR_STOP on\n\n")
+	b.WriteString(sqlrunner.Postgres.CreateVersionTable(vs.sqlStore().QuotedTable()) + ";\n")
+	for _, s := range selected {
+		if err := vs.writeMigration(&b, s, opts.Direction); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (vs *VersionStore) writeMigration(b *strings.Builder, s *sqlfile.Script, d nomad.Direction) error {
+	statements, err := s.Statements(d)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(b, "\n-- %s %s_%s (sha256 %s)\n", d, s.Version, s.Name, s.Checksum())
+	if !s.NoTransaction {
+		b.WriteString("BEGIN;\n")
+		lock, statement := s.LockTimeout, s.StatementTimeout
+		if vs.Context != nil {
+			if lock == 0 {
+				lock = vs.Context.LockTimeout
+			}
+			if statement == 0 {
+				statement = vs.Context.StatementTimeout
+			}
+		}
+		writeTimeout(b, "lock_timeout", lock)
+		writeTimeout(b, "statement_timeout", statement)
+	}
+	for _, st := range statements {
+		b.WriteString(st.SQL + ";\n")
+		if st.IsCopy() {
+			b.WriteString(st.CopyData + "\\.\n")
+		}
+	}
+
+	table, version := vs.sqlStore().QuotedTable(), quoteLiteral(s.Version)
+	if d == nomad.DirectionDown {
+		fmt.Fprintf(b, "DELETE FROM %s WHERE version = %s;\n", table, version)
+	} else {
+		fmt.Fprintf(b, "INSERT INTO %s (version) VALUES (%s);\n", table, version)
+	}
+	if !s.NoTransaction {
+		b.WriteString("COMMIT;\n")
+	}
+	return nil
+}
+
+func writeTimeout(b *strings.Builder, name string, d time.Duration) {
+	if d > 0 {
+		fmt.Fprintf(b, "SET LOCAL %s TO %s;\n", name, postgres.TimeoutValue(d))
+	}
+}
+
+func scriptPhase(s *sqlfile.Script) string {
+	if s.Phase == "" {
+		return nomad.PhasePre
+	}
+	return s.Phase
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,139 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/sqlfile"
+)
+
+var scriptFiles = fstest.MapFS{
+	"001_users.sql": {Data: []byte(`-- nomad:lock-timeout 5s
+-- nomad:up
+CREATE TABLE users (id int PRIMARY KEY, username text);
+COPY users (id, username) FROM stdin;
+1	mcls
+\.
+
+-- nomad:down
+DROP TABLE users;
+`)},
+	"002_index.sql": {Data: []byte(`-- nomad:no-transaction
+-- nomad:up
+CREATE INDEX CONCURRENTLY users_username_idx ON users (username) -- without locking users
+-- nomad:down
+DROP INDEX CONCURRENTLY users_username_idx
+`)},
+	"003_o'brien.up.sql":   {Data: []byte("SELECT 3;\n")},
+	"003_o'brien.down.sql": {Data: []byte("SELECT -3;\n")},
+}
+
+func TestWriteScript(t *testing.T) {
+	scripts, err := sqlfile.LoadScriptsFS(scriptFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	vs := NewVersionStore(nil)
+	if err := vs.WriteScript(&b, scripts, ScriptOptions{To: "002"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `-- Generated by nomad, apply with psql
+\set ON_ERROR_STOP on
+
+CREATE TABLE IF NOT EXISTS "schema_migrations" (
+  version text NOT NULL UNIQUE
+);
+
+-- up 001_users (sha256 ` + scripts[0].Checksum() + `)
+BEGIN;
+SET LOCAL lock_timeout TO '5000ms';
+CREATE TABLE users (id int PRIMARY KEY, username text);
+COPY users (id, username) FROM stdin;
+1	mcls
+\.
+INSERT INTO "schema_migrations" (version) VALUES ('001');
+COMMIT;
+
+-- up 002_index (sha256 ` + scripts[1].Checksum() + `)
+CREATE INDEX CONCURRENTLY users_username_idx ON users (username);
+INSERT INTO "schema_migrations" (version) VALUES ('002');
+`
+	if b.String() != want {
+		t.Fatalf("Expected script:\n%s\nGot:\n%s", want, b.String())
+	}
+}
+
+func TestWriteScript_Down(t *testing.T) {
+	scripts, err := sqlfile.LoadScriptsFS(scriptFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	vs := NewVersionStore(nil)
+	opts := ScriptOptions{From: "002", Direction: nomad.DirectionDown}
+	if err := vs.WriteScript(&b, scripts, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	script := b.String()
+	first := strings.Index(script, "-- down 003_o'brien")
+	second := strings.Index(script, "-- down 002_index")
+	if first < 0 || second < first {
+		t.Fatalf("Expected 003 to be rolled back before 002:\n%s", script)
+	}
+	if !strings.Contains(script, `DELETE FROM "schema_migrations" WHERE version = '003';`) {
+		t.Fatalf("Expected version 003 to be removed:\n%s", script)
+	}
+	if strings.Contains(script, "001_users") {
+		t.Fatalf("Shouldn't contain migrations before 002:\n%s", script)
+	}
+}
+
+func TestWriteScript_OnlyPending(t *testing.T) {
+	db := setupDatabase(t)
+	scripts, err := sqlfile.LoadScriptsFS(scriptFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vs := NewVersionStore(db)
+	if err := vs.SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.AddVersion("001"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := vs.WriteScript(&b, scripts, ScriptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "001_users") || !strings.Contains(b.String(), "002_index") {
+		t.Fatalf("Expected only pending migrations:\n%s", b.String())
+	}
+}
+
+func TestWriteScript_Table(t *testing.T) {
+	scripts, err := sqlfile.LoadScriptsFS(scriptFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	vs := NewVersionStore(nil)
+	vs.Table = "app.migrations"
+	if err := vs.WriteScript(&b, scripts, ScriptOptions{To: "001"}); err != nil {
+		t.Fatal(err)
+	}
+	script := b.String()
+	if !strings.Contains(script, `CREATE TABLE IF NOT EXISTS "app"."migrations" (`) ||
+		!strings.Contains(script, `INSERT INTO "app"."migrations" (version) VALUES ('001');`) {
+		t.Fatalf("Expected the versions to be stored in app.migrations:\n%s", script)
+	}
+}
@@ -0,0 +1,194 @@
+// Helps with the integration of nomad with pgx connection pools
+package pgx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/internal/postgres"
+)
+
+// NewRunner creates a nomad.Runner for postgres migrations on a pgx pool
+func NewRunner(pool *pgxpool.Pool, list *nomad.List) *nomad.Runner {
+	ctx := NewContext(pool)
+	vs := NewVersionStore(pool)
+	vs.Context = ctx
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
+}
+
+// Context is passed to every migration. Depending on the transaction mode Tx
+// is the transaction the migration runs in, or nil when it runs without one.
+type Context struct {
+	Pool      *pgxpool.Pool
+	Tx        pgx.Tx
+	TxMode    nomad.TxMode     // Default transaction mode, TxPerMigration if unset
+	Migration *nomad.Migration // Migration that's currently running
+
+	// Ctx is passed to pgx, context.Background() if nil. Canceling it stops
+	// the running migration.
+	Ctx context.Context
+
+	// Default lock_timeout and statement_timeout of migrations that run in a
+	// transaction. Zero leaves the server's setting alone.
+	LockTimeout      time.Duration
+	StatementTimeout time.Duration
+
+	timeouts postgres.Timeouts // Applied to Tx with SET LOCAL
+}
+
+func NewContext(pool *pgxpool.Pool) *Context {
+	return &Context{Pool: pool}
+}
+
+func (c *Context) ctx() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
+	}
+	return c.Ctx
+}
+
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+}
+
+// Exec runs the query in the current transaction, or on the pool when the
+// migration runs without one. It returns a sql.Result, so SQL file migrations
+// run on pgx as well.
+func (c *Context) Exec(query string, args ...interface{}) (sql.Result, error) {
+	var tag pgconn.CommandTag
+	var err error
+	if c.Tx != nil {
+		tag, err = c.Tx.Exec(c.ctx(), query, args...)
+	} else {
+		tag, err = c.Pool.Exec(c.ctx(), query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result(tag), nil
+}
+
+// result adapts a pgconn.CommandTag to sql.Result
+type result pgconn.CommandTag
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId isn't supported by postgres, use RETURNING")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return pgconn.CommandTag(r).RowsAffected(), nil
+}
+
+// CopyFrom loads rows into a table with the COPY protocol, in the current
+// transaction if there is one. It's the fastest way to load large amounts of
+// data:
+//
+//	rows := [][]interface{}{{1, "mcls"}, {2, "other"}}
+//	c.CopyFrom(pgx.Identifier{"users"}, []string{"id", "username"}, pgx.CopyFromRows(rows))
+func (c *Context) CopyFrom(table pgx.Identifier, columns []string, rows pgx.CopyFromSource) (int64, error) {
+	if c.Tx != nil {
+		return c.Tx.CopyFrom(c.ctx(), table, columns, rows)
+	}
+	return c.Pool.CopyFrom(c.ctx(), table, columns, rows)
+}
+
+// TxModes implements nomad.Transactional
+func (c *Context) TxModes() (run, migration nomad.TxMode) {
+	run = c.TxMode
+	if run == nomad.TxDefault {
+		run = nomad.TxPerMigration
+	}
+	if c.Migration == nil || c.Migration.TxMode == nomad.TxDefault {
+		return run, run
+	}
+	return run, c.Migration.TxMode
+}
+
+// InTx implements nomad.Transactional
+func (c *Context) InTx() bool {
+	return c.Tx != nil
+}
+
+// Begin starts a transaction, used by the hooks
+func (c *Context) Begin() error {
+	tx, err := c.Pool.Begin(c.ctx())
+	if err != nil {
+		return err
+	}
+	c.Tx = tx
+	return nil
+}
+
+// Commit commits the transaction, used by the hooks
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	c.timeouts = postgres.Timeouts{}
+	return tx.Commit(c.ctx())
+}
+
+// Rollback rolls back the transaction, used by the hooks
+func (c *Context) Rollback() error {
+	tx := c.Tx
+	c.Tx = nil
+	c.timeouts = postgres.Timeouts{}
+	return tx.Rollback(c.ctx())
+}
+
+// setTimeouts applies the timeouts of the current migration to Tx
+func (c *Context) setTimeouts() error {
+	defaults := postgres.Timeouts{Lock: c.LockTimeout, Statement: c.StatementTimeout}
+	return c.timeouts.Apply(c.Migration, defaults, func(query string) error {
+		_, err := c.Tx.Exec(c.ctx(), query)
+		return err
+	})
+}
+
+// TimeoutError is returned when a migration was canceled because it exceeded
+// its lock_timeout or statement_timeout
+type TimeoutError = postgres.TimeoutError
+
+// NewHooks creates the hooks that manage the transactions of a Context. They
+// work like the ones of the pg package.
+func NewHooks() *nomad.Hooks {
+	tx := &nomad.TxHooks{}
+	hooks := tx.Hooks()
+	hooks.Before = func(ctx interface{}) error {
+		c := ctx.(*Context)
+		if err := tx.Before(c); err != nil {
+			return err
+		}
+		if c.Tx == nil {
+			return nil
+		}
+		if err := c.setTimeouts(); err != nil {
+			return tx.OnError(c, err)
+		}
+		return nil
+	}
+	hooks.OnError = func(ctx interface{}, err error) error {
+		c := ctx.(*Context)
+		return tx.OnError(c, c.timeouts.Wrap(c.Migration, err))
+	}
+	return hooks
+}
+
+// IsTransient reports whether err is a postgres error that's likely to go away
+// when the migration is retried: a serialization failure, a deadlock or a
+// lock that couldn't be acquired in time.
+func IsTransient(err error) bool {
+	return postgres.IsTransient(err)
+}
+
+// NewRetryPolicy creates a policy that retries migrations that failed with a
+// transient error, with exponential backoff between the attempts
+func NewRetryPolicy(maxAttempts int) *nomad.RetryPolicy {
+	return postgres.NewRetryPolicy(maxAttempts)
+}
@@ -0,0 +1,184 @@
+package pgx
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/internal/postgres"
+	"github.com/mcls/nomad/sqlfile"
+	"github.com/mcls/nomad/sqlrunner"
+)
+
+// setupDatabase connects to PGX_TEST_DATABASE, e.g.
+// "postgres:///nomad_db_test?sslmode=disable", and skips the test when it
+// isn't set
+func setupDatabase(t *testing.T) *pgxpool.Pool {
+	url := os.Getenv("PGX_TEST_DATABASE")
+	if url == "" {
+		t.Skip("PGX_TEST_DATABASE isn't set")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	_, err = pool.Exec(context.Background(), `
+	DROP TABLE IF EXISTS schema_migrations;
+	DROP TABLE IF EXISTS users;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestImplementsInterfaces(t *testing.T) {
+	var _ nomad.VersionStore = NewVersionStore(nil)
+	var _ nomad.Locker = NewVersionStore(nil)
+	var _ nomad.VersionLister = NewVersionStore(nil)
+	var _ sqlfile.Execer = NewContext(nil)
+}
+
+func TestVersionStore_SameTableAsPg(t *testing.T) {
+	vs := NewVersionStore(nil)
+	vs.Table = "app.Migrations"
+	if table := vs.quotedTable(); table != `"app"."Migrations"` {
+		t.Fatalf("Expected the table to be quoted, got %s", table)
+	}
+	if vs.lockKey() != sqlrunner.AdvisoryLockKey("nomad:app.Migrations") {
+		t.Fatal("Expected the lock key of the pg package")
+	}
+}
+
+func TestRunAndRollback(t *testing.T) {
+	pool := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if _, err := c.Tx.Exec(c.ctx(), "CREATE TABLE users (id int PRIMARY KEY, username text)"); err != nil {
+				return err
+			}
+			rows := [][]interface{}{{1, "mcls"}, {2, "other"}}
+			n, err := c.CopyFrom(pgx.Identifier{"users"}, []string{"id", "username"}, pgx.CopyFromRows(rows))
+			if err == nil && n != 2 {
+				err = errors.New("Expected 2 rows to be copied")
+			}
+			return err
+		},
+		Down: func(ctx interface{}) error {
+			_, err := ctx.(*Context).Exec("DROP TABLE users")
+			return err
+		},
+	})
+
+	runner := NewRunner(pool, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := pool.QueryRow(context.Background(), "SELECT count(*) FROM users").Scan(&n); err != nil || n != 2 {
+		t.Fatalf("Expected 2 users, got %d (%v)", n, err)
+	}
+	if !runner.HasVersion("A") {
+		t.Fatal("Expected A to be applied")
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Expected A to be rolled back")
+	}
+}
+
+func TestRun_TxPerRun(t *testing.T) {
+	pool := setupDatabase(t)
+	create := func(ctx interface{}) error {
+		_, err := ctx.(*Context).Exec("CREATE TABLE users (id int)")
+		return err
+	}
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: create})
+	l.Add(&nomad.Migration{Version: "B", Up: create})
+
+	runner := NewRunner(pool, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected B to fail")
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Expected A to be rolled back together with B")
+	}
+}
+
+func TestLock(t *testing.T) {
+	pool := setupDatabase(t)
+	first, second := NewVersionStore(pool), NewVersionStore(pool)
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nomad.ErrLockNotAcquired {
+		t.Fatalf("Expected the lock to be held, got %v", err)
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
+
+func TestVersions_WithoutTable(t *testing.T) {
+	pool := setupDatabase(t)
+	versions, err := NewVersionStore(pool).Versions()
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions, got %v (%v)", versions, err)
+	}
+}
+
+func TestResult(t *testing.T) {
+	r := result(pgconn.NewCommandTag("INSERT 0 3"))
+	if n, err := r.RowsAffected(); err != nil || n != 3 {
+		t.Fatalf("Expected 3 rows, got %d (%v)", n, err)
+	}
+	if _, err := r.LastInsertId(); err == nil {
+		t.Fatal("Expected LastInsertId to be unsupported")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, code := range []string{"40001", "40P01", "55P03"} {
+		if !IsTransient(&pgconn.PgError{Code: code}) {
+			t.Errorf("Expected %s to be transient", code)
+		}
+	}
+	if IsTransient(&pgconn.PgError{Code: "42P01"}) || IsTransient(errors.New("Oh no")) {
+		t.Fatal("Expected other errors not to be transient")
+	}
+}
+
+func TestHooks_TimeoutError(t *testing.T) {
+	c := NewContext(nil)
+	c.Migration = &nomad.Migration{Version: "A"}
+	c.timeouts = postgres.Timeouts{Lock: time.Second}
+
+	err := NewHooks().OnError(c, &pgconn.PgError{Code: "55P03"})
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected a *TimeoutError, got %#v", err)
+	}
+	if timeoutErr.Setting != "lock_timeout" || timeoutErr.Version != "A" || timeoutErr.Timeout != time.Second {
+		t.Fatalf("Wrong timeout error: %s", timeoutErr)
+	}
+}
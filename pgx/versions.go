@@ -0,0 +1,145 @@
+package pgx
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/sqlrunner"
+)
+
+// DefaultTable stores the versions, unless VersionStore.Table is set
+const DefaultTable = sqlrunner.DefaultTable
+
+// VersionStore stores the versions with the SQL of sqlrunner.Postgres, in the
+// same table as the pg package
+type VersionStore struct {
+	Pool *pgxpool.Pool
+	// Table stores the versions, DefaultTable if empty. It can be qualified
+	// with a schema, e.g. "app.migrations".
+	Table string
+	// Context, when set, makes version changes part of the transaction the
+	// migration runs in
+	Context *Context
+
+	lockConn *pgxpool.Conn // Holds the advisory lock, see Lock
+}
+
+func NewVersionStore(pool *pgxpool.Pool) *VersionStore {
+	return &VersionStore{Pool: pool}
+}
+
+// sqlStore returns the store of sqlrunner with the table of vs, whose quoted
+// table and lock name are the pg package's
+func (vs *VersionStore) sqlStore() *sqlrunner.VersionStore {
+	return &sqlrunner.VersionStore{Dialect: sqlrunner.Postgres, Table: vs.Table}
+}
+
+func (vs *VersionStore) quotedTable() string {
+	return vs.sqlStore().QuotedTable()
+}
+
+func (vs *VersionStore) lockKey() int64 {
+	return sqlrunner.AdvisoryLockKey(vs.sqlStore().LockName())
+}
+
+type queryer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+func (vs *VersionStore) conn() queryer {
+	if vs.Context != nil && vs.Context.Tx != nil {
+		return vs.Context.Tx
+	}
+	return vs.Pool
+}
+
+func (vs *VersionStore) ctx() context.Context {
+	if vs.Context != nil {
+		return vs.Context.ctx()
+	}
+	return context.Background()
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	var found string
+	query := "SELECT version FROM " + vs.quotedTable() + " WHERE version = " + sqlrunner.Postgres.Placeholder(1)
+	err := vs.conn().QueryRow(vs.ctx(), query, v).Scan(&found)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return false
+	case err != nil:
+		panic(err)
+	default:
+		return true
+	}
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	query := "INSERT INTO " + vs.quotedTable() + " (version) VALUES (" + sqlrunner.Postgres.Placeholder(1) + ")"
+	_, err := vs.conn().Exec(vs.ctx(), query, v)
+	return err
+}
+
+func (vs *VersionStore) RemoveVersion(v string) error {
+	query := "DELETE FROM " + vs.quotedTable() + " WHERE version = " + sqlrunner.Postgres.Placeholder(1)
+	_, err := vs.conn().Exec(vs.ctx(), query, v)
+	return err
+}
+
+// SetupVersionStore creates the table to store the versions
+func (vs *VersionStore) SetupVersionStore() error {
+	_, err := vs.Pool.Exec(vs.ctx(), sqlrunner.Postgres.CreateVersionTable(vs.quotedTable()))
+	return err
+}
+
+// Versions returns the applied versions, in order. Unlike the other methods it
+// doesn't need the table to exist.
+func (vs *VersionStore) Versions() ([]string, error) {
+	versions := []string{}
+	rows, err := vs.Pool.Query(vs.ctx(), "SELECT version FROM "+vs.quotedTable()+" ORDER BY version")
+	if err == nil {
+		versions, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	}
+	if sqlrunner.Postgres.IsMissingTable(err) {
+		return []string{}, nil
+	}
+	return versions, err
+}
+
+// Lock implements nomad.Locker with a session-level advisory lock. The key is
+// the same as the one of the pg package, so runs of both exclude each other.
+// It holds on to a connection of the pool until Unlock.
+func (vs *VersionStore) Lock() error {
+	conn, err := vs.Pool.Acquire(vs.ctx())
+	if err != nil {
+		return err
+	}
+	var acquired bool
+	err = conn.QueryRow(vs.ctx(), "SELECT pg_try_advisory_lock($1)", vs.lockKey()).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Release()
+		if err == nil {
+			err = nomad.ErrLockNotAcquired
+		}
+		return err
+	}
+	vs.lockConn = conn
+	return nil
+}
+
+// Unlock releases the lock acquired by Lock
+func (vs *VersionStore) Unlock() error {
+	conn := vs.lockConn
+	if conn == nil {
+		return nil
+	}
+	vs.lockConn = nil
+	defer conn.Release()
+	_, err := conn.Exec(vs.ctx(), "SELECT pg_advisory_unlock($1)", vs.lockKey())
+	return err
+}
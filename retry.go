@@ -0,0 +1,40 @@
+package nomad
+
+import "time"
+
+// RetryPolicy determines whether a failed migration is attempted again. The
+// hooks get the chance to clean up (e.g. roll back the transaction) via
+// OnError before every new attempt.
+type RetryPolicy struct {
+	MaxAttempts int                             // Attempts in total, including the first one
+	Backoff     func(attempt int) time.Duration // Time to wait before the given attempt
+	Retryable   func(err error) bool            // Reports whether the error is transient
+}
+
+// ExponentialBackoff doubles the wait for every attempt, starting at base and
+// never exceeding max
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 2; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+func (p *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+func (p *RetryPolicy) wait(attempt int) {
+	if p.Backoff != nil {
+		time.Sleep(p.Backoff(attempt))
+	}
+}
@@ -0,0 +1,55 @@
+package sqlfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Generator creates the files of new SQL migrations
+type Generator struct {
+	Dir        string        // Where migrations will be stored
+	NewVersion func() string // Generates the migration's version
+}
+
+func NewGenerator(dir string) *Generator {
+	return &Generator{
+		Dir:        dir,
+		NewVersion: generateVersion,
+	}
+}
+
+// Create creates an empty up and down file for a new migration and returns
+// their paths
+func (g *Generator) Create(name string) ([]string, error) {
+	version := g.NewVersion()
+	files := []string{
+		filepath.Join(g.Dir, fmt.Sprintf("%s_%s.up.sql", version, name)),
+		filepath.Join(g.Dir, fmt.Sprintf("%s_%s.down.sql", version, name)),
+	}
+	if name == "" || filepath.Base(name) != name || !filePattern.MatchString(filepath.Base(files[0])) {
+		return nil, fmt.Errorf("Invalid migration name %q", name)
+	}
+
+	if err := os.MkdirAll(g.Dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		// Never overwrite an existing migration
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// generateVersion returns a timestamp, which can't contain underscores since
+// they separate the version from the name
+func generateVersion() string {
+	return time.Now().UTC().Format("20060102150405")
+}
@@ -0,0 +1,79 @@
+package sqlfile
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/mcls/nomad"
+)
+
+// Loader loads migrations whose files are text/template templates, so the
+// same migration can use e.g. a different tablespace or role per
+// environment. The templates are rendered at load time with Data, and can
+// read the environment variables listed in Env:
+//
+//	CREATE TABLE events (...) TABLESPACE {{.tablespace}};
+//	GRANT SELECT ON events TO {{env "REPORTING_ROLE"}};
+//
+// Referring to a key that's missing from Data, or to an environment variable
+// that's not listed or not set, is an error.
+type Loader struct {
+	Data   map[string]interface{}
+	Env    []string
+	Syntax Syntax // Syntax of the rendered SQL
+}
+
+// LoadScriptsFS renders and reads the scripts in fsys, in the same way as the
+// package level LoadScriptsFS
+func (l *Loader) LoadScriptsFS(fsys fs.FS) ([]*Script, error) {
+	return loadScripts(fsys, l.Syntax, l.render)
+}
+
+// LoadFS creates a list with the rendered migrations in fsys
+func (l *Loader) LoadFS(fsys fs.FS) (*nomad.List, error) {
+	scripts, err := l.LoadScriptsFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return newList(scripts), nil
+}
+
+// LoadDir creates a list with the rendered migrations in dir
+func (l *Loader) LoadDir(dir string) (*nomad.List, error) {
+	return l.LoadFS(os.DirFS(dir))
+}
+
+func (l *Loader) render(file, content string) (string, error) {
+	t, err := template.New(file).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"env": l.env}).
+		Parse(content)
+	if err != nil {
+		return "", err
+	}
+	data := l.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (l *Loader) env(name string) (string, error) {
+	for _, allowed := range l.Env {
+		if allowed != name {
+			continue
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("environment variable %s isn't set", name)
+	}
+	return "", fmt.Errorf("environment variable %s isn't listed in the loader's Env", name)
+}
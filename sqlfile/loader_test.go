@@ -0,0 +1,84 @@
+package sqlfile
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var templates = fstest.MapFS{
+	"001_events.sql": {Data: []byte(`-- nomad:up
+CREATE TABLE events (id int) TABLESPACE {{.tablespace}};
+GRANT SELECT ON events TO {{env "NOMAD_TEST_ROLE"}};
+
+-- nomad:down
+DROP TABLE events;
+`)},
+}
+
+func TestLoader_RendersTemplates(t *testing.T) {
+	t.Setenv("NOMAD_TEST_ROLE", "reporting")
+
+	l := &Loader{
+		Data: map[string]interface{}{"tablespace": "fast_ssd"},
+		Env:  []string{"NOMAD_TEST_ROLE"},
+	}
+	scripts, err := l.LoadScriptsFS(templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE TABLE events (id int) TABLESPACE fast_ssd;\nGRANT SELECT ON events TO reporting;\n\n"
+	if scripts[0].Up != want {
+		t.Fatalf("Expected rendered SQL %q, got %q", want, scripts[0].Up)
+	}
+
+	// The checksum is taken from the rendered SQL
+	l.Data["tablespace"] = "slow_hdd"
+	other, err := l.LoadScriptsFS(templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scripts[0].Checksum() == other[0].Checksum() {
+		t.Fatal("Checksums should differ when the rendered SQL differs")
+	}
+}
+
+func TestLoader_Errors(t *testing.T) {
+	t.Setenv("NOMAD_TEST_ROLE", "reporting")
+
+	cases := map[string]*Loader{
+		`map has no entry for key "tablespace"`: {
+			Env: []string{"NOMAD_TEST_ROLE"},
+		},
+		"environment variable NOMAD_TEST_ROLE isn't listed": {
+			Data: map[string]interface{}{"tablespace": "fast_ssd"},
+		},
+	}
+	for want, l := range cases {
+		_, err := l.LoadScriptsFS(templates)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error containing %q, got %v", want, err)
+		}
+	}
+
+	os.Unsetenv("NOMAD_TEST_ROLE")
+	l := &Loader{
+		Data: map[string]interface{}{"tablespace": "fast_ssd"},
+		Env:  []string{"NOMAD_TEST_ROLE"},
+	}
+	_, err := l.LoadScriptsFS(templates)
+	if err == nil || !strings.Contains(err.Error(), "environment variable NOMAD_TEST_ROLE isn't set") {
+		t.Fatalf("Expected error about unset variable, got %v", err)
+	}
+}
+
+func TestLoadScriptsFS_DoesntRenderTemplates(t *testing.T) {
+	scripts, err := LoadScriptsFS(templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scripts[0].Up, "{{.tablespace}}") {
+		t.Fatalf("Shouldn't have rendered %q", scripts[0].Up)
+	}
+}
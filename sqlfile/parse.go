@@ -0,0 +1,147 @@
+package sqlfile
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Markers and directives are comments starting with this prefix
+const directivePrefix = "-- nomad:"
+
+// parse reads a file into the script. direction is "up" or "down" for one of
+// a pair of files. Otherwise the file is split into its up and down SQL at
+// these markers:
+//
+//	-- nomad:up
+//	CREATE TABLE users (id serial PRIMARY KEY);
+//
+//	-- nomad:down
+//	DROP TABLE users;
+//
+// Both kinds of files can contain directives, which apply to the whole
+// migration:
+//
+//	-- nomad:no-transaction              Run without a transaction
+//	-- nomad:depends-on <version>...     Versions that have to be applied first
+//	-- nomad:phase <phase>               Deploy phase, e.g. post
+//	-- nomad:lock-timeout <duration>     e.g. 5s
+//	-- nomad:statement-timeout <duration>
+func (s *Script) parse(file, content, direction string) error {
+	switch direction {
+	case "up":
+		s.Up, s.UpFile, s.UpLine = content, file, 1
+	case "down":
+		s.Down, s.DownFile, s.DownLine = content, file, 1
+	default:
+		s.UpFile, s.DownFile = file, file
+	}
+
+	section := direction
+	sections := map[string]*strings.Builder{}
+	for i, line := range strings.SplitAfter(content, "\n") {
+		n := i + 1
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, directivePrefix) {
+			if direction != "" {
+				continue
+			}
+			if section == "" {
+				if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+					return lineError(file, n, "SQL before %sup", directivePrefix)
+				}
+				continue
+			}
+			sections[section].WriteString(line)
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(trimmed, directivePrefix))
+		if len(fields) == 0 {
+			return lineError(file, n, "empty directive")
+		}
+		name, args := fields[0], fields[1:]
+		if name != "up" && name != "down" {
+			if err := s.directive(name, args); err != nil {
+				return lineError(file, n, "%s", err)
+			}
+			if section != "" && direction == "" {
+				sections[section].WriteString(line)
+			}
+			continue
+		}
+
+		switch {
+		case direction != "":
+			return lineError(file, n, "%s%s is only allowed in <version>_<name>.sql files", directivePrefix, name)
+		case len(args) > 0:
+			return lineError(file, n, "%s%s doesn't take arguments", directivePrefix, name)
+		case sections[name] != nil:
+			return lineError(file, n, "%s%s appears twice", directivePrefix, name)
+		}
+		section = name
+		sections[name] = &strings.Builder{}
+		if name == "up" {
+			s.UpLine = n + 1
+		} else {
+			s.DownLine = n + 1
+		}
+	}
+
+	if direction != "" {
+		return nil
+	}
+	for _, name := range []string{"up", "down"} {
+		if sections[name] == nil {
+			return fmt.Errorf("%s: no %s%s section", file, directivePrefix, name)
+		}
+	}
+	s.Up, s.Down = sections["up"].String(), sections["down"].String()
+	return nil
+}
+
+func (s *Script) directive(name string, args []string) error {
+	switch name {
+	case "no-transaction":
+		if len(args) > 0 {
+			return fmt.Errorf("%s%s doesn't take arguments", directivePrefix, name)
+		}
+		s.NoTransaction = true
+	case "depends-on":
+		for _, arg := range args {
+			for _, v := range strings.Split(arg, ",") {
+				if v != "" {
+					s.DependsOn = append(s.DependsOn, v)
+				}
+			}
+		}
+		if len(s.DependsOn) == 0 {
+			return fmt.Errorf("%s%s needs at least one version", directivePrefix, name)
+		}
+	case "phase":
+		if len(args) != 1 {
+			return fmt.Errorf("%s%s needs one phase", directivePrefix, name)
+		}
+		s.Phase = args[0]
+	case "lock-timeout", "statement-timeout":
+		if len(args) != 1 {
+			return fmt.Errorf("%s%s needs one duration", directivePrefix, name)
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return fmt.Errorf("%s%s: invalid duration %q", directivePrefix, name, args[0])
+		}
+		if name == "lock-timeout" {
+			s.LockTimeout = d
+		} else {
+			s.StatementTimeout = d
+		}
+	default:
+		return fmt.Errorf("unknown directive %s%s", directivePrefix, name)
+	}
+	return nil
+}
+
+func lineError(file string, line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", file, line, fmt.Sprintf(format, args...))
+}
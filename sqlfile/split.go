@@ -0,0 +1,329 @@
+package sqlfile
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Statement is a single statement of a SQL script
+type Statement struct {
+	SQL      string // Statement without the terminating semicolon
+	Line     int    // Line of the script the statement starts at
+	CopyData string // Data of a COPY ... FROM stdin statement, up to the \. line
+}
+
+// IsCopy reports whether the statement is a COPY ... FROM stdin, whose data is
+// in CopyData
+func (st Statement) IsCopy() bool {
+	return copyFromStdin.MatchString(st.SQL)
+}
+
+// SyntaxError is returned by Split for a script it can't split
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var copyFromStdin = regexp.MustCompile(`(?is)^COPY\b.*\bFROM\s+STDIN\b`)
+
+// Syntax is the SQL dialect a script is split by
+type Syntax int
+
+const (
+	// SyntaxPostgres understands postgres' string literals, E'...' escape
+	// strings, quoted identifiers, dollar-quoted bodies, nested block
+	// comments and the data blocks of COPY ... FROM stdin
+	SyntaxPostgres Syntax = iota
+	// SyntaxMySQL understands MySQL's string literals with backslash
+	// escapes, backtick quoted identifiers and # comments
+	SyntaxMySQL
+)
+
+// Split splits a script into its statements, for drivers that can't execute
+// more than one statement at a time. The script is postgres SQL, see
+// Syntax.Split for other dialects.
+func Split(script string) ([]Statement, error) {
+	return SyntaxPostgres.Split(script)
+}
+
+// Split splits a script written in the syntax into its statements
+func (syn Syntax) Split(script string) ([]Statement, error) {
+	sp := &splitter{src: script, line: 1, syntax: syn}
+	return sp.split()
+}
+
+type splitter struct {
+	src    string
+	pos    int
+	line   int
+	syntax Syntax
+
+	statements []Statement
+	start      int // Position of the current statement, -1 if it didn't start yet
+	startLine  int
+	end        int // Position after the last token of the current statement
+}
+
+func (sp *splitter) split() ([]Statement, error) {
+	sp.start = -1
+	for sp.pos < len(sp.src) {
+		c := sp.src[sp.pos]
+		switch {
+		case c == '\n':
+			sp.line++
+			sp.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			sp.pos++
+		case sp.isLineComment():
+			sp.skipLineComment()
+		case c == '/' && sp.peek(1) == '*' && !sp.isHint():
+			if err := sp.skipBlockComment(); err != nil {
+				return nil, err
+			}
+		case c == ';':
+			ended := sp.endStatement()
+			sp.pos++
+			if !ended {
+				continue
+			}
+			if err := sp.readCopyData(); err != nil {
+				return nil, err
+			}
+		default:
+			sp.startStatement()
+			if err := sp.skipToken(); err != nil {
+				return nil, err
+			}
+			sp.end = sp.pos
+		}
+	}
+	sp.endStatement()
+	return sp.statements, nil
+}
+
+// isLineComment reports whether a comment up to the end of the line starts
+// at pos. MySQL also starts them with #, but requires whitespace after --.
+func (sp *splitter) isLineComment() bool {
+	c := sp.src[sp.pos]
+	if sp.syntax != SyntaxMySQL {
+		return c == '-' && sp.peek(1) == '-'
+	}
+	if c == '#' {
+		return true
+	}
+	switch sp.peek(2) {
+	case ' ', '\t', '\r', '\n', 0:
+		return c == '-' && sp.peek(1) == '-'
+	}
+	return false
+}
+
+// isHint reports whether the /* at pos starts a MySQL /*! ... */ or
+// /*+ ... */ comment, which the server executes, so it's part of the
+// statement
+func (sp *splitter) isHint() bool {
+	return sp.syntax == SyntaxMySQL && (sp.peek(2) == '!' || sp.peek(2) == '+')
+}
+
+func (sp *splitter) peek(n int) byte {
+	if sp.pos+n < len(sp.src) {
+		return sp.src[sp.pos+n]
+	}
+	return 0
+}
+
+func (sp *splitter) startStatement() {
+	if sp.start < 0 {
+		sp.start, sp.startLine = sp.pos, sp.line
+	}
+}
+
+// endStatement adds the current statement, if there is one. Comments after
+// its last token aren't part of it, so a terminator can follow it.
+func (sp *splitter) endStatement() bool {
+	if sp.start < 0 {
+		return false
+	}
+	sql := sp.src[sp.start:sp.end]
+	sp.statements = append(sp.statements, Statement{SQL: sql, Line: sp.startLine})
+	sp.start = -1
+	return true
+}
+
+// readCopyData reads the data block that follows a COPY ... FROM stdin
+// statement, which ends with a line containing only \.
+func (sp *splitter) readCopyData() error {
+	last := &sp.statements[len(sp.statements)-1]
+	if sp.syntax != SyntaxPostgres || !copyFromStdin.MatchString(last.SQL) {
+		return nil
+	}
+
+	// The data starts on the line after the statement
+	nl := strings.IndexByte(sp.src[sp.pos:], '\n')
+	if nl < 0 {
+		return &SyntaxError{last.Line, "COPY FROM stdin without data"}
+	}
+	sp.pos += nl + 1
+	sp.line++
+
+	var data strings.Builder
+	for sp.pos < len(sp.src) {
+		end := strings.IndexByte(sp.src[sp.pos:], '\n')
+		next := len(sp.src)
+		if end >= 0 {
+			next = sp.pos + end + 1
+		}
+		row := sp.src[sp.pos:next]
+		sp.pos = next
+		sp.line++
+		if strings.TrimRight(row, "\r\n") == `\.` {
+			last.CopyData = data.String()
+			return nil
+		}
+		data.WriteString(row)
+	}
+	return &SyntaxError{last.Line, `COPY data isn't terminated by \.`}
+}
+
+func (sp *splitter) skipLineComment() {
+	end := strings.IndexByte(sp.src[sp.pos:], '\n')
+	if end < 0 {
+		sp.pos = len(sp.src)
+		return
+	}
+	sp.pos += end
+}
+
+// skipBlockComment skips a /* */ comment, which can be nested in postgres
+func (sp *splitter) skipBlockComment() error {
+	line := sp.line
+	depth := 0
+	for sp.pos < len(sp.src) {
+		switch {
+		case sp.src[sp.pos] == '/' && sp.peek(1) == '*' && (depth == 0 || sp.syntax == SyntaxPostgres):
+			depth++
+			sp.pos += 2
+		case sp.src[sp.pos] == '*' && sp.peek(1) == '/':
+			depth--
+			sp.pos += 2
+			if depth == 0 {
+				return nil
+			}
+		default:
+			if sp.src[sp.pos] == '\n' {
+				sp.line++
+			}
+			sp.pos++
+		}
+	}
+	return &SyntaxError{line, "unterminated block comment"}
+}
+
+// skipToken skips a literal, quoted identifier, dollar-quoted body, MySQL
+// hint, or a single character of anything else
+func (sp *splitter) skipToken() error {
+	c := sp.src[sp.pos]
+	if sp.syntax == SyntaxMySQL {
+		switch {
+		case c == '\'' || c == '"':
+			return sp.skipQuoted(c, true)
+		case c == '`':
+			return sp.skipQuoted(c, false)
+		case c == '/' && sp.peek(1) == '*':
+			return sp.skipBlockComment()
+		}
+		sp.pos++
+		return nil
+	}
+	switch {
+	case c == '\'':
+		return sp.skipQuoted('\'', sp.isEscapeString())
+	case c == '"':
+		return sp.skipQuoted('"', false)
+	case c == '$':
+		if tag := sp.dollarTag(); tag != "" {
+			return sp.skipDollarQuoted(tag)
+		}
+	}
+	sp.pos++
+	return nil
+}
+
+// isEscapeString reports whether the quote at pos starts an E'...' string
+func (sp *splitter) isEscapeString() bool {
+	if sp.pos == 0 || (sp.src[sp.pos-1] != 'E' && sp.src[sp.pos-1] != 'e') {
+		return false
+	}
+	return sp.pos == 1 || !isIdentChar(sp.src[sp.pos-2])
+}
+
+func (sp *splitter) skipQuoted(quote byte, backslashEscapes bool) error {
+	line := sp.line
+	sp.pos++
+	for sp.pos < len(sp.src) {
+		c := sp.src[sp.pos]
+		switch {
+		case c == '\\' && backslashEscapes:
+			if sp.peek(1) == '\n' {
+				sp.line++
+			}
+			sp.pos += 2
+			continue
+		case c == quote && sp.peek(1) == quote:
+			sp.pos += 2
+			continue
+		case c == quote:
+			sp.pos++
+			return nil
+		case c == '\n':
+			sp.line++
+		}
+		sp.pos++
+	}
+	if quote == '`' || quote == '"' && sp.syntax == SyntaxPostgres {
+		return &SyntaxError{line, "unterminated quoted identifier"}
+	}
+	return &SyntaxError{line, "unterminated string literal"}
+}
+
+// dollarTag returns the $tag$ that starts at pos, or an empty string if
+// there's none, e.g. for a $1 parameter
+func (sp *splitter) dollarTag() string {
+	if sp.pos > 0 && isIdentChar(sp.src[sp.pos-1]) {
+		return ""
+	}
+	for i := sp.pos + 1; i < len(sp.src); i++ {
+		c := sp.src[i]
+		switch {
+		case c == '$':
+			return sp.src[sp.pos : i+1]
+		case c >= '0' && c <= '9' && i == sp.pos+1:
+			return ""
+		case !isIdentChar(c):
+			return ""
+		}
+	}
+	return ""
+}
+
+func (sp *splitter) skipDollarQuoted(tag string) error {
+	line := sp.line
+	body := sp.pos + len(tag)
+	end := strings.Index(sp.src[body:], tag)
+	if end < 0 {
+		return &SyntaxError{line, "unterminated dollar-quoted string " + tag}
+	}
+	next := body + end + len(tag)
+	sp.line += strings.Count(sp.src[sp.pos:next], "\n")
+	sp.pos = next
+	return nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,131 @@
+package sqlfile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	script := `-- Create the users
+CREATE TABLE users (
+  id serial PRIMARY KEY,
+  username text DEFAULT 'a;b' -- not the end;
+);
+
+/* Nested /* block; */ comment; */
+INSERT INTO users (username) VALUES ('it''s; fine'), (E'escaped \' quote;');
+CREATE FUNCTION touch() RETURNS trigger AS $body$
+BEGIN
+  NEW.updated_at := now(); -- inside the body
+  RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;
+SELECT $$a;b$$, "semi;colon" FROM users WHERE id = $1;;
+COPY users (id, username) FROM stdin;
+1	mcls;
+2	\N
+\.
+SELECT 1 -- the last one`
+	statements, err := Split(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		line   int
+		prefix string
+	}{
+		{2, "CREATE TABLE users"},
+		{8, "INSERT INTO users"},
+		{9, "CREATE FUNCTION touch()"},
+		{15, "SELECT $$a;b$$"},
+		{16, "COPY users"},
+		{20, "SELECT 1"},
+	}
+	if len(statements) != len(want) {
+		for _, st := range statements {
+			t.Logf("%d: %q", st.Line, st.SQL)
+		}
+		t.Fatalf("Expected %d statements, got %d", len(want), len(statements))
+	}
+	for i, w := range want {
+		st := statements[i]
+		if st.Line != w.line || !strings.HasPrefix(st.SQL, w.prefix) {
+			t.Fatalf("Expected statement %d at line %d to start with %q, got %d: %q", i, w.line, w.prefix, st.Line, st.SQL)
+		}
+	}
+
+	if statements[0].SQL != "CREATE TABLE users (\n  id serial PRIMARY KEY,\n  username text DEFAULT 'a;b' -- not the end;\n)" {
+		t.Fatalf("Wrong statement: %q", statements[0].SQL)
+	}
+	if !strings.HasSuffix(statements[2].SQL, "$body$ LANGUAGE plpgsql") {
+		t.Fatalf("Function body wasn't kept together: %q", statements[2].SQL)
+	}
+	if statements[4].CopyData != "1\tmcls;\n2\t\\N\n" {
+		t.Fatalf("Wrong COPY data: %q", statements[4].CopyData)
+	}
+	if statements[5].SQL != "SELECT 1" {
+		t.Fatalf("Expected the trailing comment to be left out: %q", statements[5].SQL)
+	}
+}
+
+func TestSplit_Errors(t *testing.T) {
+	cases := map[string]string{
+		"line 2: unterminated string literal":            "SELECT 1;\nSELECT 'a;\n",
+		"line 1: unterminated quoted identifier":         `SELECT "a;`,
+		"line 2: unterminated block comment":             "SELECT 1;\n/* /* */ SELECT 2;",
+		"line 1: unterminated dollar-quoted string $fn$": "SELECT $fn$ a; $$;",
+		`line 2: COPY data isn't terminated by \.`:       "SELECT 1;\nCOPY users FROM stdin;\n1\tmcls\n",
+		"line 1: unterminated string literal":            `SELECT E'\';`,
+	}
+	for want, script := range cases {
+		_, err := Split(script)
+		if err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q for %q, got %v", want, script, err)
+		}
+	}
+}
+
+func TestSplit_Empty(t *testing.T) {
+	statements, err := Split("-- Nothing to do\n;\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 0 {
+		t.Fatalf("Expected no statements, got %q", statements)
+	}
+}
+
+func TestSplit_MySQL(t *testing.T) {
+	script := "# Create the users;\n" +
+		"CREATE TABLE `semi;colon` (id int) -- not the end;\n" +
+		";\n" +
+		"INSERT INTO t VALUES ('it\\'s; fine'), (\"a\\\";b\");\n" +
+		"/*!40101 SET NAMES utf8mb4 */;\n" +
+		"SELECT 1--1;\n" +
+		"/* not /* nested */ SELECT `a;b` FROM t"
+	statements, err := SyntaxMySQL.Split(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Statement{
+		{SQL: "CREATE TABLE `semi;colon` (id int)", Line: 2},
+		{SQL: `INSERT INTO t VALUES ('it\'s; fine'), ("a\";b")`, Line: 4},
+		{SQL: "/*!40101 SET NAMES utf8mb4 */", Line: 5},
+		{SQL: "SELECT 1--1", Line: 6},
+		{SQL: "SELECT `a;b` FROM t", Line: 7},
+	}
+	if len(statements) != len(want) {
+		t.Fatalf("Expected %d statements, got %q", len(want), statements)
+	}
+	for i, w := range want {
+		if statements[i] != w {
+			t.Fatalf("Expected statement %d to be %q at line %d, got %q at line %d", i, w.SQL, w.Line, statements[i].SQL, statements[i].Line)
+		}
+	}
+
+	_, err = SyntaxMySQL.Split("SELECT `a;")
+	if err == nil || err.Error() != "line 1: unterminated quoted identifier" {
+		t.Fatalf("Expected an unterminated identifier, got %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+// Loads migrations written in plain SQL, so they don't need to be compiled in
+package sqlfile
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcls/nomad"
+)
+
+// Execer is implemented by contexts that can execute SQL, like pg.Context
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Copier is implemented by contexts that can load the data of a
+// COPY ... FROM stdin statement, like pg.Context
+type Copier interface {
+	CopyFrom(query, data string) error
+}
+
+// Script is a migration read from SQL files. It's either a pair of up and
+// down files, or a single file with both sections. For templates, Up and Down
+// hold the rendered SQL.
+type Script struct {
+	Version  string
+	Name     string
+	Up       string // SQL executed when migrating
+	Down     string // SQL executed when rolling back
+	UpFile   string // File the Up SQL was read from
+	DownFile string // File the Down SQL was read from
+	UpLine   int    // Line of UpFile the Up SQL starts at
+	DownLine int    // Line of DownFile the Down SQL starts at
+	Syntax   Syntax // Syntax the SQL is split by
+
+	// Set by -- nomad:<directive> comments in the files
+	NoTransaction    bool
+	DependsOn        []string
+	Phase            string
+	LockTimeout      time.Duration
+	StatementTimeout time.Duration
+}
+
+// Migration creates a migration that executes the SQL of the script on the
+// context it's run with, which has to implement Execer
+func (s *Script) Migration() *nomad.Migration {
+	m := &nomad.Migration{
+		Version:          s.Version,
+		Up:               s.exec(nomad.DirectionUp),
+		Down:             s.exec(nomad.DirectionDown),
+		Phase:            s.Phase,
+		DependsOn:        s.DependsOn,
+		LockTimeout:      s.LockTimeout,
+		StatementTimeout: s.StatementTimeout,
+	}
+	if s.NoTransaction {
+		m.TxMode = nomad.TxNone
+	}
+	return m
+}
+
+// Checksum identifies the SQL of the script. Two scripts have the same
+// checksum when they execute the same SQL.
+func (s *Script) Checksum() string {
+	h := sha256.New()
+	io.WriteString(h, s.Up)
+	h.Write([]byte{0})
+	io.WriteString(h, s.Down)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Statements splits the up or down SQL of the script into statements, with
+// the lines of the file they were read from
+func (s *Script) Statements(d nomad.Direction) ([]Statement, error) {
+	file, line, script := s.UpFile, s.UpLine, s.Up
+	if d == nomad.DirectionDown {
+		file, line, script = s.DownFile, s.DownLine, s.Down
+	}
+	if line == 0 {
+		line = 1
+	}
+	statements, err := s.Syntax.Split(script)
+	if err != nil {
+		if syntaxErr, ok := err.(*SyntaxError); ok {
+			return nil, lineError(file, line+syntaxErr.Line-1, "%s", syntaxErr.Msg)
+		}
+		return nil, err
+	}
+	for i := range statements {
+		statements[i].Line += line - 1
+	}
+	return statements, nil
+}
+
+// exec executes the statements one by one, so a failure can be traced back
+// to its line
+func (s *Script) exec(d nomad.Direction) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		e, ok := ctx.(Execer)
+		if !ok {
+			return fmt.Errorf("Context %T can't execute SQL", ctx)
+		}
+		statements, err := s.Statements(d)
+		if err != nil {
+			return err
+		}
+		file := s.UpFile
+		if d == nomad.DirectionDown {
+			file = s.DownFile
+		}
+		for _, st := range statements {
+			if err := execStatement(ctx, e, st); err != nil {
+				return fmt.Errorf("%s:%d: %w", file, st.Line, err)
+			}
+		}
+		return nil
+	}
+}
+
+func execStatement(ctx interface{}, e Execer, st Statement) error {
+	if !st.IsCopy() {
+		_, err := e.Exec(st.SQL)
+		return err
+	}
+	c, ok := ctx.(Copier)
+	if !ok {
+		return fmt.Errorf("Context %T can't run COPY FROM stdin", ctx)
+	}
+	return c.CopyFrom(st.SQL, st.CopyData)
+}
+
+// Files are named <version>_<name>.up.sql and <version>_<name>.down.sql, or
+// <version>_<name>.sql for single files
+var filePattern = regexp.MustCompile(`^([^_]+)_(.+?)(?:\.(up|down))?\.sql$`)
+
+// LoadScripts reads the scripts in dir and its subdirectories, sorted by
+// version
+func LoadScripts(dir string) ([]*Script, error) {
+	return LoadScriptsFS(os.DirFS(dir))
+}
+
+// LoadScriptsFS reads the scripts in fsys, e.g. an embed.FS, sorted by
+// version. Subdirectories are read as well, so migrations can be grouped per
+// module, but versions have to be unique across all of them.
+func LoadScriptsFS(fsys fs.FS) ([]*Script, error) {
+	return SyntaxPostgres.LoadScriptsFS(fsys)
+}
+
+// LoadScriptsFS reads the scripts in fsys like the package level
+// LoadScriptsFS, for SQL written in the syntax
+func (syn Syntax) LoadScriptsFS(fsys fs.FS) ([]*Script, error) {
+	return loadScripts(fsys, syn, nil)
+}
+
+func loadScripts(fsys fs.FS, syn Syntax, render func(file, content string) (string, error)) ([]*Script, error) {
+	byVersion := map[string]*Script{}
+	err := fs.WalkDir(fsys, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(file) != ".sql" {
+			return nil
+		}
+		match := filePattern.FindStringSubmatch(d.Name())
+		if match == nil {
+			return fmt.Errorf("%s: name doesn't match <version>_<name>.sql", file)
+		}
+		version, name, direction := match[1], match[2], match[3]
+
+		raw, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		content := string(raw)
+		if render != nil {
+			if content, err = render(file, content); err != nil {
+				return err
+			}
+		}
+
+		s, ok := byVersion[version]
+		switch {
+		case !ok:
+			s = &Script{Version: version, Name: name, Syntax: syn}
+			byVersion[version] = s
+		case direction == "", s.UpFile == s.DownFile, s.Name != name, path.Dir(file) != path.Dir(s.file()):
+			return fmt.Errorf("%s: version %q is also used by %s", file, version, s.file())
+		}
+		return s.parse(file, content, direction)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make([]*Script, 0, len(byVersion))
+	for _, s := range byVersion {
+		scripts = append(scripts, s)
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Version < scripts[j].Version
+	})
+	for _, s := range scripts {
+		switch {
+		case s.UpFile == "":
+			return nil, fmt.Errorf("%s: no matching up file %s", s.DownFile, pairedFile(s.DownFile))
+		case s.DownFile == "":
+			return nil, fmt.Errorf("%s: no matching down file %s", s.UpFile, pairedFile(s.UpFile))
+		}
+		for _, d := range []nomad.Direction{nomad.DirectionUp, nomad.DirectionDown} {
+			if _, err := s.Statements(d); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return scripts, nil
+}
+
+// file returns one of the files the script was read from
+func (s *Script) file() string {
+	if s.UpFile != "" {
+		return s.UpFile
+	}
+	return s.DownFile
+}
+
+// pairedFile returns the down file for an up file and vice versa
+func pairedFile(file string) string {
+	if strings.HasSuffix(file, ".up.sql") {
+		return strings.TrimSuffix(file, ".up.sql") + ".down.sql"
+	}
+	return strings.TrimSuffix(file, ".down.sql") + ".up.sql"
+}
+
+// LoadDir creates a list with the migrations in dir and its subdirectories
+func LoadDir(dir string) (*nomad.List, error) {
+	return SyntaxPostgres.LoadDir(dir)
+}
+
+// LoadFS creates a list with the migrations in fsys. This allows shipping
+// migrations inside the binary:
+//
+//	//go:embed migrations
+//	var migrationFiles embed.FS
+//
+//	migrations, err := sqlfile.LoadFS(migrationFiles)
+func LoadFS(fsys fs.FS) (*nomad.List, error) {
+	return SyntaxPostgres.LoadFS(fsys)
+}
+
+// LoadDir creates a list with the migrations in dir, for SQL written in the
+// syntax:
+//
+//	migrations, err := sqlfile.SyntaxMySQL.LoadDir("./migrations")
+func (syn Syntax) LoadDir(dir string) (*nomad.List, error) {
+	return syn.LoadFS(os.DirFS(dir))
+}
+
+// LoadFS creates a list with the migrations in fsys, for SQL written in the
+// syntax
+func (syn Syntax) LoadFS(fsys fs.FS) (*nomad.List, error) {
+	scripts, err := syn.LoadScriptsFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return newList(scripts), nil
+}
+
+func newList(scripts []*Script) *nomad.List {
+	list := nomad.NewList()
+	for _, s := range scripts {
+		list.Add(s.Migration())
+	}
+	return list
+}
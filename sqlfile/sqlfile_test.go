@@ -0,0 +1,333 @@
+package sqlfile
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/inmem"
+)
+
+// Context records the SQL it's asked to execute
+type Context struct {
+	Queries []string
+	Copied  []string
+	Err     error
+	FailOn  string
+}
+
+func (c *Context) Exec(query string, args ...interface{}) (sql.Result, error) {
+	c.Queries = append(c.Queries, query)
+	if c.FailOn != "" && strings.HasPrefix(query, c.FailOn) {
+		return nil, errors.New("Oh no")
+	}
+	return nil, c.Err
+}
+
+func (c *Context) CopyFrom(query, data string) error {
+	c.Copied = append(c.Copied, data)
+	return nil
+}
+
+func TestLoadScripts(t *testing.T) {
+	scripts, err := LoadScripts("testdata/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 2 {
+		t.Fatalf("Expected 2 scripts, got %d", len(scripts))
+	}
+
+	s := scripts[0]
+	if s.Version != "001" || s.Name != "create_users" {
+		t.Fatalf("Expected 001_create_users first, got %s_%s", s.Version, s.Name)
+	}
+	if !strings.HasPrefix(s.Up, "CREATE TABLE users") {
+		t.Fatalf("Wrong up SQL: %q", s.Up)
+	}
+	if s.Down != "DROP TABLE users;\n" {
+		t.Fatalf("Wrong down SQL: %q", s.Down)
+	}
+	if scripts[1].Version != "002" {
+		t.Fatalf("Expected 002 second, got %s", scripts[1].Version)
+	}
+}
+
+func TestLoadScripts_InvalidName(t *testing.T) {
+	_, err := LoadScripts("testdata/invalid_name")
+	if err == nil || !strings.Contains(err.Error(), "create_users.sql") {
+		t.Fatalf("Expected error about create_users.sql, got %v", err)
+	}
+}
+
+func TestLoadDir_RunsSQL(t *testing.T) {
+	l, err := LoadDir("testdata/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Context{}
+	runner := inmem.NewRunner(l, c)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Queries) != 2 || !strings.HasPrefix(c.Queries[1], "CREATE TABLE posts") {
+		t.Fatalf("Executed wrong queries: %q", c.Queries)
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Queries[2] != "DROP TABLE posts" {
+		t.Fatalf("Executed wrong query: %q", c.Queries[2])
+	}
+}
+
+func TestMigration_ReportsFile(t *testing.T) {
+	s := &Script{Version: "001", Up: "SELECT 1", UpFile: "001_select.up.sql"}
+	c := &Context{Err: errors.New("Oh no")}
+	err := s.Migration().Up(c)
+	if err == nil || err.Error() != "001_select.up.sql:1: Oh no" {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+}
+
+func TestMigration_RequiresExecer(t *testing.T) {
+	s := &Script{Version: "001", Up: "SELECT 1"}
+	if err := s.Migration().Up(&nomad.List{}); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+//go:embed testdata/migrations
+var embedded embed.FS
+
+func TestLoadFS_Embedded(t *testing.T) {
+	scripts, err := LoadScriptsFS(embedded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 2 || scripts[0].UpFile != "testdata/migrations/001_create_users.up.sql" {
+		t.Fatalf("Didn't load embedded scripts: %v", scripts)
+	}
+}
+
+func TestLoadFS_Subdirectories(t *testing.T) {
+	fsys := fstest.MapFS{
+		"users/003_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD email text;")},
+		"users/003_add_email.down.sql":    {Data: []byte("ALTER TABLE users DROP email;")},
+		"users/001_create_users.up.sql":   {Data: []byte("CREATE TABLE users ();")},
+		"users/001_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"billing/002_invoices.up.sql":     {Data: []byte("CREATE TABLE invoices ();")},
+		"billing/002_invoices.down.sql":   {Data: []byte("DROP TABLE invoices;")},
+	}
+	l, err := LoadFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []string{"001", "002", "003"} {
+		if x := l.Get(i).Version; x != v {
+			t.Fatalf("Expected elem at %d to be '%s', but was '%s'", i, v, x)
+		}
+	}
+}
+
+func TestLoadFS_Errors(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"001_a.up.sql: no matching down file 001_a.down.sql": {
+			"001_a.up.sql": {},
+		},
+		"users/001_a.down.sql: no matching up file users/001_a.up.sql": {
+			"users/001_a.down.sql": {},
+		},
+		`users/001_b.up.sql: version "001" is also used by billing/001_a.up.sql`: {
+			"billing/001_a.down.sql": {},
+			"billing/001_a.up.sql":   {},
+			"users/001_b.up.sql":     {},
+		},
+		`users/001_a.up.sql: version "001" is also used by billing/001_a.up.sql`: {
+			"billing/001_a.down.sql": {},
+			"billing/001_a.up.sql":   {},
+			"users/001_a.up.sql":     {},
+		},
+	}
+	for want, fsys := range cases {
+		_, err := LoadFS(fsys)
+		if err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadScripts_SingleFile(t *testing.T) {
+	scripts, err := LoadScripts("testdata/single")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := scripts[0]
+	if s.Version != "003" || s.Name != "index_usernames" {
+		t.Fatalf("Expected 003_index_usernames, got %s_%s", s.Version, s.Name)
+	}
+	if s.Up != "CREATE INDEX CONCURRENTLY users_username_idx\n  ON users (username);\n\n" || s.UpLine != 7 {
+		t.Fatalf("Wrong up SQL at line %d: %q", s.UpLine, s.Up)
+	}
+	if s.Down != "DROP INDEX CONCURRENTLY users_username_idx;\n" || s.DownLine != 11 {
+		t.Fatalf("Wrong down SQL at line %d: %q", s.DownLine, s.Down)
+	}
+
+	m := s.Migration()
+	if m.TxMode != nomad.TxNone {
+		t.Fatal("Should run without a transaction")
+	}
+	if len(m.DependsOn) != 2 || m.DependsOn[0] != "001" || m.DependsOn[1] != "002" {
+		t.Fatalf("Wrong dependencies: %q", m.DependsOn)
+	}
+	if m.LockTimeout != 5*time.Second {
+		t.Fatalf("Wrong lock timeout: %s", m.LockTimeout)
+	}
+}
+
+func TestLoadFS_SingleFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"001_a.sql:2: SQL before -- nomad:up":                                       "-- nomad:phase post\nSELECT 1;\n-- nomad:up\n",
+		"001_a.sql: no -- nomad:down section":                                       "-- nomad:up\nSELECT 1;\n",
+		"001_a.sql:3: -- nomad:up appears twice":                                    "-- nomad:up\n-- nomad:down\n-- nomad:up\n",
+		"001_a.sql:2: unknown directive -- nomad:transaction":                       "-- nomad:up\n  -- nomad:transaction off\n-- nomad:down\n",
+		`001_a.sql:1: -- nomad:lock-timeout: invalid duration "soon"`:               "-- nomad:lock-timeout soon\n",
+		"001_a.sql:1: -- nomad:depends-on needs at least one version":               "-- nomad:depends-on\n",
+		"001_a.sql:1: -- nomad:no-transaction doesn't take arguments":               "-- nomad:no-transaction please\n",
+		"001_a.up.sql:1: -- nomad:up is only allowed in <version>_<name>.sql files": "-- nomad:up\n",
+	}
+	for want, content := range cases {
+		file := "001_a.sql"
+		if strings.HasPrefix(want, "001_a.up.sql") {
+			file = "001_a.up.sql"
+		}
+		_, err := LoadFS(fstest.MapFS{file: {Data: []byte(content)}})
+		if err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadFS_SingleFileAndPairWithSameVersion(t *testing.T) {
+	_, err := LoadFS(fstest.MapFS{
+		"001_a.sql":      {Data: []byte("-- nomad:up\n-- nomad:down\n")},
+		"001_a.up.sql":   {},
+		"001_a.down.sql": {},
+	})
+	if err == nil || !strings.Contains(err.Error(), `version "001" is also used by`) {
+		t.Fatalf("Expected error about version 001, got %v", err)
+	}
+}
+
+func TestPairedFiles_Directives(t *testing.T) {
+	scripts, err := LoadScriptsFS(fstest.MapFS{
+		"001_a.up.sql":   {Data: []byte("-- nomad:phase post\nALTER TABLE users DROP email;\n")},
+		"001_a.down.sql": {Data: []byte("ALTER TABLE users ADD email text;\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scripts[0].Phase != nomad.PhasePost {
+		t.Fatalf("Expected phase post, got %q", scripts[0].Phase)
+	}
+}
+
+func TestMigration_ReportsLineOfFailedStatement(t *testing.T) {
+	scripts, err := LoadScriptsFS(fstest.MapFS{
+		"001_users.sql": {Data: []byte(`-- nomad:up
+CREATE TABLE users (id int, username text);
+
+COPY users (id, username) FROM stdin;
+1	mcls
+\.
+INSERT INTO users
+  VALUES (2, 'x');
+
+-- nomad:down
+DROP TABLE users;
+`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Context{FailOn: "INSERT"}
+	err = scripts[0].Migration().Up(c)
+	if err == nil || err.Error() != "001_users.sql:7: Oh no" {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+	if len(c.Copied) != 1 || c.Copied[0] != "1\tmcls\n" {
+		t.Fatalf("Wrong COPY data: %q", c.Copied)
+	}
+}
+
+func TestLoadFS_ReportsSyntaxErrors(t *testing.T) {
+	_, err := LoadFS(fstest.MapFS{
+		"001_a.sql": {Data: []byte("-- nomad:up\nSELECT 1;\n\n-- nomad:down\nSELECT 'a;\n")},
+	})
+	if err == nil || err.Error() != "001_a.sql:5: unterminated string literal" {
+		t.Fatalf("Wrong error returned: '%s'", err)
+	}
+}
+
+func TestLoadFS_MySQL(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_a.sql": {Data: []byte("-- nomad:up\n# Quote it;\nINSERT INTO t VALUES ('it\\'s; fine');\n\n-- nomad:down\nDELETE FROM t;\n")},
+	}
+	if _, err := LoadFS(fsys); err == nil {
+		t.Fatal("Expected postgres to reject the backslash escape")
+	}
+	l, err := SyntaxMySQL.LoadFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{}
+	if err := l.Get(0).Up(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Queries) != 1 || c.Queries[0] != `INSERT INTO t VALUES ('it\'s; fine')` {
+		t.Fatalf("Wrong statements: %q", c.Queries)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	g := NewGenerator(t.TempDir())
+	g.NewVersion = func() string { return "20151128090000" }
+	files, err := g.Create("create_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || !strings.HasSuffix(files[0], "20151128090000_create_users.up.sql") ||
+		!strings.HasSuffix(files[1], "20151128090000_create_users.down.sql") {
+		t.Fatalf("Wrong files: %v", files)
+	}
+
+	scripts, err := LoadScripts(g.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 1 || scripts[0].Version != "20151128090000" || scripts[0].Name != "create_users" {
+		t.Fatalf("Expected the new migration to be loaded, got %+v", scripts)
+	}
+
+	if _, err := g.Create("create_users"); err == nil {
+		t.Fatal("Expected an error instead of overwriting the migration")
+	}
+	if _, err := g.Create("../users"); err == nil {
+		t.Fatal("Expected an error for an invalid name")
+	}
+}
+
+func TestGenerator_NewVersion(t *testing.T) {
+	v := NewGenerator("migrations").NewVersion()
+	if !filePattern.MatchString(v+"_name.sql") || strings.Contains(v, "_") {
+		t.Fatalf("Version %q can't be used in file names", v)
+	}
+}
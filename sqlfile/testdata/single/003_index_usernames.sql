@@ -0,0 +1,11 @@
+-- Usernames are looked up on every login
+-- nomad:no-transaction
+-- nomad:depends-on 001,002
+-- nomad:lock-timeout 5s
+
+-- nomad:up
+CREATE INDEX CONCURRENTLY users_username_idx
+  ON users (username);
+
+-- nomad:down
+DROP INDEX CONCURRENTLY users_username_idx;
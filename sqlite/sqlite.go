@@ -0,0 +1,162 @@
+// Helps with the integration of nomad with SQLite
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mcls/nomad"
+	"github.com/mcls/nomad/sqlrunner"
+)
+
+// NewRunner creates a nomad.Runner for SQLite migrations. Every connection to
+// an in-memory database opens a database of its own, so limit db to one
+// connection with db.SetMaxOpenConns(1) for those.
+func NewRunner(db *sql.DB, list *nomad.List) *nomad.Runner {
+	ctx := NewContext(db)
+	vs := NewVersionStore(db)
+	vs.Context = ctx
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
+}
+
+// Context is passed to every migration. It's the Context of sqlrunner, whose
+// transactions run on a connection of their own.
+type Context struct {
+	*sqlrunner.Context
+	Conn *sql.Conn // Connection Tx runs on
+
+	// DisableForeignKeys turns off the enforcement of foreign keys while a
+	// transaction is open, which the table rebuilds of SQLite's ALTER TABLE
+	// procedure need. The foreign keys are checked before committing.
+	DisableForeignKeys bool
+
+	// foreignKeys is set when enforcement was on before it got disabled
+	foreignKeys bool
+}
+
+func NewContext(db *sql.DB) *Context {
+	return &Context{Context: sqlrunner.NewContext(db, sqlrunner.SQLite)}
+}
+
+// Begin starts a transaction on a connection of its own, since PRAGMA
+// foreign_keys has to be set on the same connection, before the transaction
+// starts
+func (c *Context) Begin() error {
+	ctx := context.Background()
+	conn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	c.Conn = conn
+	if c.DisableForeignKeys {
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&c.foreignKeys); err != nil {
+			c.release()
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			c.release()
+			return err
+		}
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		c.release()
+		return err
+	}
+	c.Tx = tx
+	return nil
+}
+
+// release turns the foreign keys back on, if they were disabled, and returns
+// the connection to the pool
+func (c *Context) release() error {
+	conn := c.Conn
+	c.Conn = nil
+	var err error
+	if c.foreignKeys {
+		_, err = conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+		c.foreignKeys = false
+	}
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Commit checks the foreign keys, if they were disabled, and commits
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	err := c.checkForeignKeys(tx)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if releaseErr := c.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// Rollback rolls back the transaction and releases its connection
+func (c *Context) Rollback() error {
+	err := c.Context.Rollback()
+	if releaseErr := c.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// checkForeignKeys reports the first violation of a foreign key, which can't
+// be caught while they're disabled
+func (c *Context) checkForeignKeys(tx *sql.Tx) error {
+	if !c.DisableForeignKeys {
+		return nil
+	}
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		return fmt.Errorf("Foreign key violation: row %d of %q references a missing row of %q", rowid.Int64, table, parent)
+	}
+	return rows.Err()
+}
+
+// NewHooks creates the hooks that manage the transactions of a Context, see
+// nomad.TxHooks. SQLite can roll back schema changes, so a failed migration
+// leaves no trace, and statements like VACUUM can run with TxNone.
+func NewHooks() *nomad.Hooks {
+	return (&nomad.TxHooks{}).Hooks()
+}
+
+// IsTransient reports whether err means that the database was locked by
+// another connection, which is likely to go away when the migration is
+// retried
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// DefaultTable stores the versions, unless VersionStore.Table is set
+const DefaultTable = sqlrunner.DefaultTable
+
+// VersionStore is the one of sqlrunner, with the SQLite dialect
+type VersionStore = sqlrunner.VersionStore
+
+func NewVersionStore(db *sql.DB) *VersionStore {
+	return sqlrunner.NewVersionStore(db, sqlrunner.SQLite)
+}
@@ -0,0 +1,257 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	// Pure Go SQLite driver, registered as "sqlite"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/mcls/nomad"
+)
+
+func setupDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single connection shows that the hooks never wait for a second one
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func exec(query string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		_, err := ctx.(*Context).Exec(query)
+		return err
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestRunAndRollback(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up:      exec("CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT)"),
+		Down:    exec("DROP TABLE users"),
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !tableExists(t, db, "users") {
+		t.Fatal("Expected A to be applied")
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.HasVersion("A") || tableExists(t, db, "users") {
+		t.Fatal("Expected A to be rolled back")
+	}
+}
+
+func TestRun_RollsBackFailedMigration(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if _, err := c.Tx.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY)"); err != nil {
+				return err
+			}
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil || err.Error() != "Oh no" {
+		t.Fatalf("Expected the migration to fail, got %v", err)
+	}
+	if runner.HasVersion("A") || tableExists(t, db, "users") {
+		t.Fatal("Expected the schema change to be rolled back")
+	}
+}
+
+func TestRun_TxPerRun(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")})
+	l.Add(&nomad.Migration{Version: "B", Up: exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected B to fail")
+	}
+	if runner.HasVersion("A") || tableExists(t, db, "users") {
+		t.Fatal("Expected A to be rolled back together with B")
+	}
+}
+
+func TestRun_TxNone(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")})
+	l.Add(&nomad.Migration{Version: "B", TxMode: nomad.TxNone, Up: exec("VACUUM")})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !runner.HasVersion("B") {
+		t.Fatal("Expected A and B to be applied")
+	}
+}
+
+func TestRun_DoesntRetryTxNone(t *testing.T) {
+	db := setupDatabase(t)
+	attempts := 0
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		TxMode:  nomad.TxNone,
+		Up: func(ctx interface{}) error {
+			attempts += 1
+			return errors.New("database is locked")
+		},
+	})
+
+	runner := NewRunner(db, l)
+	runner.Retry = &nomad.RetryPolicy{MaxAttempts: 3, Retryable: IsTransient}
+	if err := runner.Run(); err == nil || err.Error() != "database is locked" {
+		t.Fatalf("Expected the migration to fail, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+// rebuildUsers changes the type of users.name the way SQLite's docs
+// recommend, by copying the table
+var rebuildUsers = &nomad.Migration{
+	Version: "B",
+	Up: func(ctx interface{}) error {
+		c := ctx.(*Context)
+		for _, query := range []string{
+			"CREATE TABLE new_users (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+			"INSERT INTO new_users SELECT id, name FROM users",
+			"DROP TABLE users",
+			"ALTER TABLE new_users RENAME TO users",
+		} {
+			if _, err := c.Tx.Exec(query); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func setupForeignKeys(t *testing.T) *sql.DB {
+	db := setupDatabase(t)
+	for _, query := range []string{
+		"PRAGMA foreign_keys = ON",
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, name)",
+		"CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users (id))",
+		"INSERT INTO users VALUES (1, 'mcls')",
+		"INSERT INTO posts VALUES (1, 1)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestDisableForeignKeys(t *testing.T) {
+	db := setupForeignKeys(t)
+	l := nomad.NewList()
+	l.Add(rebuildUsers)
+
+	runner := NewRunner(db, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected dropping users to violate the foreign key")
+	}
+
+	runner.Context.(*Context).DisableForeignKeys = true
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var enabled bool
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&enabled); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Fatal("Expected foreign keys to be enforced again")
+	}
+}
+
+func TestDisableForeignKeys_ChecksBeforeCommit(t *testing.T) {
+	db := setupForeignKeys(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: exec("DELETE FROM users")})
+
+	runner := NewRunner(db, l)
+	runner.Context.(*Context).DisableForeignKeys = true
+	err := runner.Run()
+	if err == nil || !strings.Contains(err.Error(), `row 1 of "posts" references a missing row of "users"`) {
+		t.Fatalf("Expected a foreign key violation, got %v", err)
+	}
+	if runner.HasVersion("A") {
+		t.Fatal("Shouldn't have version A")
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM users").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("Expected the delete to be rolled back, got %d users (%v)", n, err)
+	}
+}
+
+func TestVersionStore_Table(t *testing.T) {
+	db := setupDatabase(t)
+	vs := NewVersionStore(db)
+	vs.Table = "migrations"
+
+	versions, err := vs.Versions()
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions without a table, got %v (%v)", versions, err)
+	}
+	if err := vs.SetupVersionStore(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"B", "A"} {
+		if err := vs.AddVersion(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err = vs.Versions()
+	if err != nil || strings.Join(versions, ",") != "A,B" {
+		t.Fatalf("Expected A,B, got %v (%v)", versions, err)
+	}
+	if !tableExists(t, db, "migrations") || tableExists(t, db, "schema_migrations") {
+		t.Fatal("Expected the versions to be stored in migrations")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	if !IsTransient(errors.New("database is locked (5) (SQLITE_BUSY)")) {
+		t.Fatal("Expected a locked database to be transient")
+	}
+	if IsTransient(errors.New("no such table: users")) || IsTransient(nil) {
+		t.Fatal("Expected other errors not to be transient")
+	}
+}
@@ -0,0 +1,152 @@
+package sqlrunner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// Dialect describes the SQL that differs between databases
+type Dialect interface {
+	// Placeholder returns the placeholder of the nth argument, starting at 1
+	Placeholder(n int) string
+	// QuoteIdentifier quotes a name, which can be qualified, e.g. app.migrations
+	QuoteIdentifier(name string) string
+	// CreateVersionTable returns the statement that creates the quoted table
+	// with a version column, unless it exists
+	CreateVersionTable(table string) string
+	// TransactionalDDL reports whether schema changes can be rolled back
+	TransactionalDDL() bool
+	// IsMissingTable reports whether err means that a table doesn't exist
+	IsMissingTable(err error) bool
+}
+
+// LockingDialect is implemented by dialects of databases with named locks,
+// which keep two runs from migrating at the same time
+type LockingDialect interface {
+	Dialect
+	// Lock tries to acquire the lock on conn, without waiting for it
+	Lock(conn *sql.Conn, name string) (acquired bool, err error)
+	Unlock(conn *sql.Conn, name string) error
+}
+
+// quoteParts quotes every part of a qualified name
+func quoteParts(name string, quote string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.Replace(part, quote, quote+quote, -1) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// sqlState is implemented by the errors of postgres drivers, e.g. lib/pq and
+// pgx, which the dialects can't import
+type sqlState interface {
+	SQLState() string
+}
+
+type postgres struct{}
+
+// Postgres is the dialect of PostgreSQL, which locks with advisory locks
+var Postgres LockingDialect = postgres{}
+
+func (postgres) Placeholder(n int) string           { return fmt.Sprintf("$%d", n) }
+func (postgres) QuoteIdentifier(name string) string { return quoteParts(name, `"`) }
+func (postgres) TransactionalDDL() bool             { return true }
+
+// CreateVersionTable returns the table the pg package has always created
+func (postgres) CreateVersionTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (\n  version text NOT NULL UNIQUE\n)"
+}
+
+func (postgres) IsMissingTable(err error) bool {
+	var stateErr sqlState
+	return errors.As(err, &stateErr) && stateErr.SQLState() == "42P01"
+}
+
+func (postgres) Lock(conn *sql.Conn, name string) (bool, error) {
+	var acquired bool
+	err := conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1)", AdvisoryLockKey(name)).Scan(&acquired)
+	return acquired, err
+}
+
+func (postgres) Unlock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", AdvisoryLockKey(name))
+	return err
+}
+
+// AdvisoryLockKey turns a name into the key of a postgres advisory lock, for
+// drivers that lock without database/sql, like pgx
+func AdvisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// MySQLDialect is the dialect of MySQL and MariaDB, which commit implicitly
+// around DDL statements and lock with GET_LOCK
+type MySQLDialect struct {
+	// LockWait is how long Lock waits for another run to finish, in whole
+	// seconds. Zero gives up right away.
+	LockWait time.Duration
+}
+
+// MySQL is the MySQLDialect that doesn't wait for locks
+var MySQL LockingDialect = MySQLDialect{}
+
+func (MySQLDialect) Placeholder(n int) string           { return "?" }
+func (MySQLDialect) QuoteIdentifier(name string) string { return quoteParts(name, "`") }
+func (MySQLDialect) TransactionalDDL() bool             { return false }
+
+func (MySQLDialect) CreateVersionTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (\n  version VARCHAR(255) NOT NULL PRIMARY KEY\n)"
+}
+
+// IsMissingTable checks the message, since the dialect can't import the
+// driver's error type
+func (MySQLDialect) IsMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Error 1146")
+}
+
+func (d MySQLDialect) Lock(conn *sql.Conn, name string) (bool, error) {
+	// GET_LOCK returns 1 when the lock was acquired and 0 when it's held by
+	// another session
+	var acquired sql.NullInt64
+	wait := int(d.LockWait / time.Second)
+	err := conn.QueryRowContext(context.Background(), "SELECT GET_LOCK(?, ?)", mysqlLockName(name), wait).Scan(&acquired)
+	return acquired.Int64 == 1, err
+}
+
+func (MySQLDialect) Unlock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", mysqlLockName(name))
+	return err
+}
+
+// mysqlLockName truncates name to the 64 characters lock names are limited to
+func mysqlLockName(name string) string {
+	if len(name) > 64 {
+		return name[:64]
+	}
+	return name
+}
+
+type sqlite struct{}
+
+// SQLite is the dialect of SQLite, which has no named locks
+var SQLite Dialect = sqlite{}
+
+func (sqlite) Placeholder(n int) string           { return "?" }
+func (sqlite) QuoteIdentifier(name string) string { return quoteParts(name, `"`) }
+func (sqlite) TransactionalDDL() bool             { return true }
+
+func (sqlite) CreateVersionTable(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (\n  version TEXT NOT NULL PRIMARY KEY\n)"
+}
+
+func (sqlite) IsMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
@@ -0,0 +1,262 @@
+// Runs migrations on any database/sql driver. What differs between databases
+// is described by a Dialect, so supporting another one only needs a Dialect.
+package sqlrunner
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/mcls/nomad"
+)
+
+// NewRunner creates a nomad.Runner for the database of a dialect
+func NewRunner(db *sql.DB, dialect Dialect, list *nomad.List) *nomad.Runner {
+	ctx := NewContext(db, dialect)
+	vs := NewVersionStore(db, dialect)
+	vs.Context = ctx
+	return nomad.NewRunner(vs, list, ctx, NewHooks())
+}
+
+// Context is passed to every migration. Depending on the transaction mode Tx
+// is the transaction the migration runs in, or nil when it runs without one.
+type Context struct {
+	DB      *sql.DB
+	Dialect Dialect
+	Tx      *sql.Tx
+	// Default transaction mode. If unset it's TxPerMigration for databases
+	// with transactional DDL, and TxNone for others.
+	TxMode    nomad.TxMode
+	Migration *nomad.Migration // Migration that's currently running
+}
+
+func NewContext(db *sql.DB, dialect Dialect) *Context {
+	return &Context{DB: db, Dialect: dialect}
+}
+
+// SetMigration implements nomad.MigrationSetter
+func (c *Context) SetMigration(m *nomad.Migration, d nomad.Direction) {
+	c.Migration = m
+}
+
+// Exec runs the query in the current transaction, or directly on the database
+// when the migration runs without one
+func (c *Context) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if c.Tx != nil {
+		return c.Tx.Exec(query, args...)
+	}
+	return c.DB.Exec(query, args...)
+}
+
+// TxModes implements nomad.Transactional
+func (c *Context) TxModes() (run, migration nomad.TxMode) {
+	switch {
+	case c.TxMode != nomad.TxDefault:
+		run = c.TxMode
+	case c.Dialect.TransactionalDDL():
+		run = nomad.TxPerMigration
+	default:
+		run = nomad.TxNone
+	}
+	if c.Migration == nil || c.Migration.TxMode == nomad.TxDefault {
+		return run, run
+	}
+	return run, c.Migration.TxMode
+}
+
+// InTx implements nomad.Transactional
+func (c *Context) InTx() bool {
+	return c.Tx != nil
+}
+
+// SQLTx implements TxContext
+func (c *Context) SQLTx() *sql.Tx {
+	return c.Tx
+}
+
+// Begin starts a transaction, used by the hooks
+func (c *Context) Begin() error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+	c.Tx = tx
+	return nil
+}
+
+// Commit commits the transaction, used by the hooks
+func (c *Context) Commit() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Commit()
+}
+
+// Rollback rolls back the transaction, used by the hooks
+func (c *Context) Rollback() error {
+	tx := c.Tx
+	c.Tx = nil
+	return tx.Rollback()
+}
+
+// NewHooks creates the hooks that manage the transactions of a Context, see
+// nomad.TxHooks. Without transactional DDL a failed migration can leave some
+// of its changes behind, so migrations run without a transaction unless they
+// ask for one.
+func NewHooks() *nomad.Hooks {
+	return (&nomad.TxHooks{}).Hooks()
+}
+
+// DefaultTable stores the versions, unless VersionStore.Table is set
+const DefaultTable = "schema_migrations"
+
+// TxContext is implemented by contexts whose open transaction the
+// VersionStore changes the versions in, so they're committed together with
+// the migration
+type TxContext interface {
+	SQLTx() *sql.Tx // Open transaction, nil if there is none
+}
+
+// VersionStore stores the versions in a table, with the SQL of a dialect. The
+// pg and mysql packages build on it.
+type VersionStore struct {
+	DB      *sql.DB
+	Dialect Dialect
+	// Table stores the versions, DefaultTable if empty. It's quoted by the
+	// dialect.
+	Table string
+	// Context, when set, makes version changes part of the transaction the
+	// migration runs in
+	Context TxContext
+
+	lockConn *sql.Conn // Holds the lock, see Lock
+}
+
+func NewVersionStore(db *sql.DB, dialect Dialect) *VersionStore {
+	return &VersionStore{DB: db, Dialect: dialect}
+}
+
+func (vs *VersionStore) table() string {
+	if vs.Table == "" {
+		return DefaultTable
+	}
+	return vs.Table
+}
+
+// QuotedTable returns the table, quoted by the dialect
+func (vs *VersionStore) QuotedTable() string {
+	return vs.Dialect.QuoteIdentifier(vs.table())
+}
+
+// Queryer is implemented by *sql.DB and *sql.Tx
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Conn returns the transaction of the migration that's running, if there is
+// one, or else DB
+func (vs *VersionStore) Conn() Queryer {
+	if vs.Context != nil {
+		if tx := vs.Context.SQLTx(); tx != nil {
+			return tx
+		}
+	}
+	return vs.DB
+}
+
+func (vs *VersionStore) HasVersion(v string) bool {
+	var found string
+	query := "SELECT version FROM " + vs.QuotedTable() + " WHERE version = " + vs.Dialect.Placeholder(1)
+	err := vs.Conn().QueryRow(query, v).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case err != nil:
+		panic(err)
+	default:
+		return true
+	}
+}
+
+func (vs *VersionStore) AddVersion(v string) error {
+	query := "INSERT INTO " + vs.QuotedTable() + " (version) VALUES (" + vs.Dialect.Placeholder(1) + ")"
+	_, err := vs.Conn().Exec(query, v)
+	return err
+}
+
+func (vs *VersionStore) RemoveVersion(v string) error {
+	query := "DELETE FROM " + vs.QuotedTable() + " WHERE version = " + vs.Dialect.Placeholder(1)
+	_, err := vs.Conn().Exec(query, v)
+	return err
+}
+
+// SetupVersionStore creates the table to store the versions
+func (vs *VersionStore) SetupVersionStore() error {
+	_, err := vs.DB.Exec(vs.Dialect.CreateVersionTable(vs.QuotedTable()))
+	return err
+}
+
+// Versions returns the applied versions, in order. Unlike the other methods it
+// doesn't need the table to exist.
+func (vs *VersionStore) Versions() ([]string, error) {
+	rows, err := vs.DB.Query("SELECT version FROM " + vs.QuotedTable() + " ORDER BY version")
+	if err != nil {
+		if vs.Dialect.IsMissingTable(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	versions := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Lock implements nomad.Locker for a LockingDialect, so two runs against the
+// same table can't migrate at the same time. It holds on to a connection of
+// DB until Unlock, which databases also release the lock with when the
+// process dies. For other dialects it does nothing.
+func (vs *VersionStore) Lock() error {
+	dialect, ok := vs.Dialect.(LockingDialect)
+	if !ok {
+		return nil
+	}
+	conn, err := vs.DB.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	acquired, err := dialect.Lock(conn, vs.LockName())
+	if err != nil || !acquired {
+		conn.Close()
+		if err == nil {
+			err = nomad.ErrLockNotAcquired
+		}
+		return err
+	}
+	vs.lockConn = conn
+	return nil
+}
+
+// Unlock releases the lock acquired by Lock
+func (vs *VersionStore) Unlock() error {
+	conn := vs.lockConn
+	if conn == nil {
+		return nil
+	}
+	vs.lockConn = nil
+	err := vs.Dialect.(LockingDialect).Unlock(conn, vs.LockName())
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// LockName is unique per table
+func (vs *VersionStore) LockName() string {
+	return "nomad:" + vs.table()
+}
@@ -0,0 +1,182 @@
+package sqlrunner
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	// Pure Go SQLite driver, registered as "sqlite"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/mcls/nomad"
+)
+
+func setupDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func exec(query string) func(ctx interface{}) error {
+	return func(ctx interface{}) error {
+		_, err := ctx.(*Context).Exec(query)
+		return err
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+// nonTransactional pretends SQLite can't roll back schema changes
+type nonTransactional struct{ Dialect }
+
+func (nonTransactional) TransactionalDDL() bool { return false }
+
+func TestImplementsInterfaces(t *testing.T) {
+	vs := NewVersionStore(nil, SQLite)
+	var _ nomad.VersionStore = vs
+	var _ nomad.Locker = vs
+	var _ nomad.VersionLister = vs
+}
+
+func TestRunAndRollback(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up:      exec("CREATE TABLE users (id INTEGER PRIMARY KEY)"),
+		Down:    exec("DROP TABLE users"),
+	})
+
+	runner := NewRunner(db, SQLite, l)
+	runner.VersionStore.(*VersionStore).Table = "app migrations"
+	if err := runner.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.HasVersion("A") || !tableExists(t, db, "users") || !tableExists(t, db, "app migrations") {
+		t.Fatal("Expected A to be applied")
+	}
+	versions, err := runner.VersionStore.(*VersionStore).Versions()
+	if err != nil || len(versions) != 1 || versions[0] != "A" {
+		t.Fatalf("Expected versions [A], got %v (%v)", versions, err)
+	}
+
+	if err := runner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.HasVersion("A") || tableExists(t, db, "users") {
+		t.Fatal("Expected A to be rolled back")
+	}
+}
+
+func TestRun_TxPerRun(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{Version: "A", Up: exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")})
+	l.Add(&nomad.Migration{Version: "B", Up: exec("CREATE TABLE users (id INTEGER PRIMARY KEY)")})
+
+	runner := NewRunner(db, SQLite, l)
+	runner.Context.(*Context).TxMode = nomad.TxPerRun
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected B to fail")
+	}
+	if runner.HasVersion("A") || tableExists(t, db, "users") {
+		t.Fatal("Expected A to be rolled back together with B")
+	}
+}
+
+func TestRun_WithoutTransactionalDDL(t *testing.T) {
+	db := setupDatabase(t)
+	l := nomad.NewList()
+	l.Add(&nomad.Migration{
+		Version: "A",
+		Up: func(ctx interface{}) error {
+			c := ctx.(*Context)
+			if c.Tx != nil {
+				t.Fatal("Expected no transaction")
+			}
+			if _, err := c.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY)"); err != nil {
+				return err
+			}
+			return errors.New("Oh no")
+		},
+	})
+
+	runner := NewRunner(db, nonTransactional{SQLite}, l)
+	if err := runner.Run(); err == nil {
+		t.Fatal("Expected A to fail")
+	}
+	if runner.HasVersion("A") || !tableExists(t, db, "users") {
+		t.Fatal("Expected the table to stay, without version A")
+	}
+}
+
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		dialect     Dialect
+		placeholder string
+		quoted      string
+	}{
+		{Postgres, "$2", `"app"."schema ""migrations"""`},
+		{MySQL, "?", "`app`.`schema \"migrations\"`"},
+		{SQLite, "?", `"app"."schema ""migrations"""`},
+	}
+	for _, test := range tests {
+		if p := test.dialect.Placeholder(2); p != test.placeholder {
+			t.Errorf("Expected placeholder %s, got %s", test.placeholder, p)
+		}
+		if q := test.dialect.QuoteIdentifier(`app.schema "migrations"`); q != test.quoted {
+			t.Errorf("Expected %s, got %s", test.quoted, q)
+		}
+	}
+	if MySQL.TransactionalDDL() || !Postgres.TransactionalDDL() {
+		t.Fatal("Only MySQL lacks transactional DDL")
+	}
+}
+
+func TestDialects_IsMissingTable(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		err     error
+	}{
+		{Postgres, stateError("42P01")},
+		{MySQL, errors.New("Error 1146 (42S02): Table 'nomad.schema_migrations' doesn't exist")},
+		{SQLite, errors.New("no such table: schema_migrations")},
+	}
+	for _, test := range tests {
+		if !test.dialect.IsMissingTable(test.err) {
+			t.Errorf("Expected %v to be a missing table", test.err)
+		}
+		if test.dialect.IsMissingTable(errors.New("Oh no")) || test.dialect.IsMissingTable(nil) {
+			t.Errorf("Expected other errors not to be a missing table")
+		}
+	}
+}
+
+// stateError is an error with a SQLSTATE, like the ones of postgres drivers
+type stateError string
+
+func (e stateError) Error() string    { return "SQLSTATE " + string(e) }
+func (e stateError) SQLState() string { return string(e) }
+
+func TestMySQLLockName(t *testing.T) {
+	vs := NewVersionStore(nil, MySQL)
+	if name := mysqlLockName(vs.LockName()); name != "nomad:schema_migrations" {
+		t.Fatalf("Wrong lock name %q", name)
+	}
+	vs.Table = strings.Repeat("a", 100)
+	if name := mysqlLockName(vs.LockName()); len(name) != 64 {
+		t.Fatalf("Lock name %q is too long", name)
+	}
+}
@@ -0,0 +1,108 @@
+package nomad
+
+import "log"
+
+// Transactional is implemented by contexts whose transactions are managed by
+// TxHooks
+type Transactional interface {
+	// TxModes returns the transaction mode of the run and the one of the
+	// current migration, neither of which is TxDefault
+	TxModes() (run, migration TxMode)
+	InTx() bool // Reports whether a transaction is open
+	Begin() error
+	Commit() error
+	Rollback() error
+}
+
+// TxHooks run the migrations of a Transactional context in transactions,
+// according to their TxMode. With TxPerMigration every migration runs in its
+// own transaction. With TxPerRun all pending migrations share one, so either
+// all of them are committed or none are. A migration using TxNone runs
+// without a transaction; during a TxPerRun run this commits the migrations
+// before it and starts a new transaction for the ones after it.
+//
+// A failed migration isn't retried when it ran without a transaction, since
+// nothing rolled back what it did before failing, or when its TxPerRun
+// transaction also held earlier migrations, which were rolled back with it.
+type TxHooks struct {
+	shared    bool // The open transaction holds migrations that already finished
+	discarded bool // Such a transaction got rolled back
+}
+
+// Hooks returns the hooks, which packages can wrap to do more
+func (h *TxHooks) Hooks() *Hooks {
+	return &Hooks{
+		Before:   h.Before,
+		After:    h.After,
+		OnError:  h.OnError,
+		AfterRun: h.AfterRun,
+		OnRetry:  h.OnRetry,
+	}
+}
+
+func (h *TxHooks) commit(c Transactional) error {
+	h.shared = false
+	return c.Commit()
+}
+
+func (h *TxHooks) Before(ctx interface{}) error {
+	c := ctx.(Transactional)
+	h.discarded = false
+	if _, mode := c.TxModes(); mode == TxNone {
+		// Some statements can't run inside a transaction, so close the one of
+		// the run if it's open
+		if c.InTx() {
+			return h.commit(c)
+		}
+		return nil
+	}
+	if !c.InTx() {
+		return c.Begin()
+	}
+	return nil
+}
+
+func (h *TxHooks) After(ctx interface{}) error {
+	c := ctx.(Transactional)
+	if !c.InTx() {
+		return nil
+	}
+	if run, _ := c.TxModes(); run == TxPerRun {
+		h.shared = true
+		return nil
+	}
+	return h.commit(c)
+}
+
+func (h *TxHooks) AfterRun(ctx interface{}) error {
+	c := ctx.(Transactional)
+	if !c.InTx() {
+		return nil
+	}
+	return h.commit(c)
+}
+
+func (h *TxHooks) OnError(ctx interface{}, origErr error) error {
+	c := ctx.(Transactional)
+	if !c.InTx() {
+		return origErr
+	}
+	h.discarded = h.shared
+	h.shared = false
+	if err := c.Rollback(); err != nil {
+		return err
+	}
+	return origErr
+}
+
+func (h *TxHooks) OnRetry(ctx interface{}, attempt int, origErr error) error {
+	if _, mode := ctx.(Transactional).TxModes(); mode == TxNone {
+		log.Printf("Not retrying, the migration ran without a transaction")
+		return origErr
+	}
+	if h.discarded {
+		log.Printf("Not retrying, the transaction of the run was rolled back")
+		return origErr
+	}
+	return nil
+}